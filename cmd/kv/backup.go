@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/vansilich/db/internal/kv"
+)
+
+// the attempts of a backup while another process keeps committing
+const backupRetries = 100
+
+// kv backup <src> <dst>
+//
+// While another process has the database opened for writes, the snapshot
+// is the last commit in its meta page, see `kv.BackupFile`.
+func cmdBackup(args []string) int {
+	if len(args) != 2 {
+		fmt.Fprintln(stderr, "usage: kv backup <src> <dst>")
+		return exitUsage
+	}
+	return exitCode("backup", func() error {
+		db, err := openReadOnly(args[0])
+		if err != nil && !errors.Is(err, kv.ErrLocked) {
+			return err
+		}
+		backup := func(w io.Writer) error {
+			return kv.BackupFile(args[0], w)
+		}
+		if db != nil {
+			defer db.Close()
+			backup = db.Backup
+		}
+
+		// an existing file is not overwritten
+		f, err := os.OpenFile(args[1], os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if err != nil {
+			return err
+		}
+		for i := 0; ; i++ {
+			err = writeBackup(f, backup)
+			if !errors.Is(err, kv.ErrBackupChanged) || i+1 == backupRetries {
+				break
+			}
+		}
+		if err == nil {
+			err = f.Sync()
+		}
+		if e := f.Close(); err == nil {
+			err = e
+		}
+		if err != nil {
+			_ = os.Remove(args[1]) // don't leave a partial backup
+		}
+		return err
+	}())
+}
+
+// write a backup from the start of the file
+func writeBackup(f *os.File, backup func(w io.Writer) error) error {
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if err := backup(w); err != nil {
+		return err
+	}
+	return w.Flush()
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCmdBackup(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.db")
+	dst := filepath.Join(dir, "backup.db")
+	runCases(t, []cmdCase{
+		{"set a", cmdSet, []string{path, "a", "1"}, exitOK, ""},
+		{"set b", cmdSet, []string{path, "b", "2"}, exitOK, ""},
+		{"backup", cmdBackup, []string{path, dst}, exitOK, ""},
+		{"scan the backup", cmdScan, []string{dst}, exitOK, "a\t1\nb\t2\n"},
+		{"an existing file", cmdBackup, []string{path, dst}, exitFailure, ""},
+		{"a missing file", cmdBackup, []string{path + ".missing", dst + ".new"}, exitFailure, ""},
+		{"no destination", cmdBackup, []string{path}, exitUsage, ""},
+	})
+
+	// while another process writes, the lock is per open file
+	db, err := openDB(path)
+	if err != nil {
+		t.Fatalf("open: %s", err.Error())
+	}
+	defer db.Close()
+	if err = db.Set([]byte("c"), []byte("3")); err != nil {
+		t.Fatalf("KV.Set: %s", err.Error())
+	}
+	runCases(t, []cmdCase{
+		{"hot backup", cmdBackup, []string{path, dst + ".hot"}, exitOK, ""},
+		{"scan the hot backup", cmdScan, []string{dst + ".hot"}, exitOK, "a\t1\nb\t2\nc\t3\n"},
+	})
+	if code, out, _ := runCmd(t, cmdCheck, dst+".hot"); code != exitOK || !strings.HasSuffix(out, "OK\n") {
+		t.Fatalf("check the hot backup: %d, %q", code, out)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/vansilich/db/internal/kv"
+)
+
+// kv check <file>
+func cmdCheck(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(stderr, "usage: kv check <file>")
+		return exitUsage
+	}
+
+	res, err := kv.Check(args[0])
+	if err != nil {
+		fmt.Fprintf(stderr, "kv check: %s\n", err.Error())
+		return exitFailure
+	}
+
+	for _, v := range res.Violations {
+		fmt.Fprintln(stdout, v)
+	}
+	for _, ptr := range res.Leaked {
+		fmt.Fprintf(stdout, "page %d: leaked\n", ptr)
+	}
+	fmt.Fprintf(stdout, "pages: %d, version: %d\n", res.Pages, res.Version)
+	fmt.Fprintf(stdout, "tree: %d levels, %d internal nodes, %d leaves, %d keys, %d overflow pages\n",
+		res.Tree.Depth, res.Tree.Nodes, res.Tree.Leaves, res.Tree.Keys, res.Tree.Overflow)
+	fmt.Fprintf(stdout, "free list: %d nodes, %d free pages\n", res.FreeNodes, res.FreePages)
+	if !res.OK() {
+		fmt.Fprintf(stdout, "FAILED: %d violations, %d leaked pages\n", len(res.Violations), len(res.Leaked))
+		return exitFailure
+	}
+	fmt.Fprintln(stdout, "OK")
+	return exitOK
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/vansilich/db/internal/kv"
+)
+
+// kv compact [--in-place] <file>
+func cmdCompact(args []string) int {
+	f := flag.NewFlagSet("compact", flag.ContinueOnError)
+	f.SetOutput(stderr)
+	inPlace := f.Bool("in-place", false, "only truncate the free pages at the end of the file")
+	f.Usage = func() {
+		fmt.Fprintf(stderr, "usage: kv compact [flags] <file>\n\nflags:\n")
+		f.PrintDefaults()
+	}
+	if err := f.Parse(args); err != nil {
+		return exitUsage
+	}
+	if f.NArg() != 1 {
+		f.Usage()
+		return exitUsage
+	}
+	return exitCode("compact", func() error {
+		db, err := openDB(f.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		var stats kv.CompactStats
+		if *inPlace {
+			stats, err = db.CompactInPlace()
+		} else {
+			// written next to the database, then renamed over it. a file
+			// left by a crashed run is removed, the database is locked.
+			dst := f.Arg(0) + ".compact"
+			if err = os.Remove(dst); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+			stats, err = db.Compact(dst)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "pages:     %d -> %d\n", stats.PagesBefore, stats.PagesAfter)
+		fmt.Fprintf(stdout, "file size: %d -> %d\n", stats.SizeBefore, stats.SizeAfter)
+		return nil
+	}())
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/vansilich/db/internal/kv"
+)
+
+// a database with most of its keys deleted one by one, the free pages
+// are at the end of the file
+func shrinkableDB(t *testing.T, path string) {
+	t.Helper()
+	db := &kv.KV{Path: path, Sync: kv.SyncNone}
+	if err := db.Open(); err != nil {
+		t.Fatalf("KV.Open: %s", err.Error())
+	}
+	defer db.Close()
+	var b kv.Batch
+	for i := 0; i < 2000; i++ {
+		b.Set([]byte(fmt.Sprintf("key_%04d", i)), []byte(strings.Repeat("v", 100)))
+	}
+	if err := db.Write(&b); err != nil {
+		t.Fatalf("KV.Write: %s", err.Error())
+	}
+	for i := 0; i < 2000; i++ {
+		if i%100 == 0 {
+			continue
+		}
+		if _, err := db.Del([]byte(fmt.Sprintf("key_%04d", i))); err != nil {
+			t.Fatalf("KV.Del: %s", err.Error())
+		}
+	}
+}
+
+// parse the before and after numbers of `kv compact`
+func compactOutput(t *testing.T, out string) (pages, size [2]int64) {
+	t.Helper()
+	_, err := fmt.Sscanf(out, "pages:     %d -> %d\nfile size: %d -> %d\n", &pages[0], &pages[1], &size[0], &size[1])
+	if err != nil {
+		t.Fatalf("output %q: %s", out, err.Error())
+	}
+	return pages, size
+}
+
+func TestCmdCompact(t *testing.T) {
+	dir := t.TempDir()
+	for _, inPlace := range []bool{false, true} {
+		path := filepath.Join(dir, fmt.Sprintf("test_%v.db", inPlace))
+		shrinkableDB(t, path)
+		args := []string{path}
+		if inPlace {
+			args = []string{"--in-place", path}
+		} else {
+			// left by a crashed run
+			if err := os.WriteFile(path+".compact", []byte("partial"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		code, out, errOut := runCmd(t, cmdCompact, args...)
+		if code != exitOK {
+			t.Fatalf("compact %v: exit code %d: %s", args, code, errOut)
+		}
+		pages, size := compactOutput(t, out)
+		if pages[1] >= pages[0] || size[1] >= size[0] {
+			t.Fatalf("compact %v: not shrunk: %q", args, out)
+		}
+		finfo, err := os.Stat(path)
+		if err != nil || finfo.Size() != size[1] {
+			t.Fatalf("compact %v: file size %d, %v, printed %d", args, finfo.Size(), err, size[1])
+		}
+		if _, err = os.Stat(path + ".compact"); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("compact %v: the temporary file is left: %v", args, err)
+		}
+
+		runCases(t, []cmdCase{
+			{"count", cmdCount, []string{path}, exitOK, "20\n"},
+			{"get", cmdGet, []string{path, "key_1900"}, exitOK, strings.Repeat("v", 100) + "\n"},
+		})
+		if code, out, _ := runCmd(t, cmdCheck, path); code != exitOK || !strings.HasSuffix(out, "OK\n") {
+			t.Fatalf("check after compact %v: %d, %q", args, code, out)
+		}
+	}
+
+	runCases(t, []cmdCase{
+		{"a missing file", cmdCompact, []string{filepath.Join(dir, "missing.db")}, exitFailure, ""},
+		{"no file", cmdCompact, nil, exitUsage, ""},
+		{"unknown flag", cmdCompact, []string{"--bad", filepath.Join(dir, "test_true.db")}, exitUsage, ""},
+	})
+}
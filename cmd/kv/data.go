@@ -0,0 +1,302 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/vansilich/db/internal/kv"
+	"github.com/vansilich/db/pkg/btree"
+)
+
+var errNotFound = errors.New("key not found")
+
+// flags shared by the data commands
+type dataFlags struct {
+	*flag.FlagSet
+	keyEnc encoding
+	valEnc encoding
+	args   []string // the positional arguments
+}
+
+func newDataFlags(name, args string) *dataFlags {
+	f := &dataFlags{
+		FlagSet: flag.NewFlagSet(name, flag.ContinueOnError),
+		keyEnc:  encRaw,
+		valEnc:  encRaw,
+	}
+	f.SetOutput(stderr)
+	f.Var(&f.keyEnc, "key-encoding", "encoding of keys: raw, hex, base64")
+	f.Var(&f.valEnc, "value-encoding", "encoding of values: raw, hex, base64")
+	f.Usage = func() {
+		fmt.Fprintf(stderr, "usage: kv %s [flags] %s\n\nflags:\n", name, args)
+		f.PrintDefaults()
+	}
+	return f
+}
+
+// parse the flags and check the number of positional arguments. flags
+// may follow the arguments, everything after "--" is an argument.
+func (f *dataFlags) parse(args []string, nargs int) bool {
+	for {
+		if err := f.Parse(args); err != nil {
+			return false
+		}
+		rest := f.FlagSet.Args()
+		if len(rest) == 0 {
+			break
+		}
+		if len(rest) < len(args) && args[len(args)-len(rest)-1] == "--" {
+			f.args = append(f.args, rest...)
+			break
+		}
+		f.args = append(f.args, rest[0])
+		args = rest[1:]
+	}
+	if len(f.args) != nargs {
+		f.Usage()
+		return false
+	}
+	return true
+}
+
+// the i-th positional argument
+func (f *dataFlags) Arg(i int) string {
+	return f.args[i]
+}
+
+// open an existing database, a missing file is not created
+func openDB(path string) (*kv.KV, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	return createDB(path, 0, "")
+}
+
+// open an existing database for reads
+func openReadOnly(path string) (*kv.KV, error) {
+	db := &kv.KV{Path: path}
+	if err := db.OpenReadOnly(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// open a database, a missing file is created with the page size and
+// the built-in comparator. empty arguments mean the defaults.
+func createDB(path string, pageSize int, comparator string) (*kv.KV, error) {
+	db := &kv.KV{Path: path, PageSize: pageSize}
+	if comparator != "" {
+		cmp, ok := btree.ComparatorByName(comparator)
+		if !ok {
+			return nil, fmt.Errorf("unknown comparator %q", comparator)
+		}
+		db.Comparator = cmp
+	}
+	if err := db.Open(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// report the result of a command
+func exitCode(cmd string, err error) int {
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, errNotFound):
+		fmt.Fprintf(stderr, "kv %s: %s\n", cmd, err.Error())
+		return exitNotFound
+	default:
+		fmt.Fprintf(stderr, "kv %s: %s\n", cmd, err.Error())
+		return exitFailure
+	}
+}
+
+// kv get <file> <key>
+func cmdGet(args []string) int {
+	f := newDataFlags("get", "<file> <key>")
+	if !f.parse(args, 2) {
+		return exitUsage
+	}
+	return exitCode("get", func() error {
+		key, err := f.keyEnc.decode(f.Arg(1))
+		if err != nil {
+			return fmt.Errorf("bad key: %w", err)
+		}
+		db, err := openReadOnly(f.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		val, found, err := db.Get(key)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return errNotFound
+		}
+		fmt.Fprintln(stdout, f.valEnc.encode(val))
+		return nil
+	}())
+}
+
+// kv set <file> <key> <value>
+func cmdSet(args []string) int {
+	f := newDataFlags("set", "<file> <key> <value>")
+	pageSize := f.Int("page-size", 0, "page size of a new database, 4096 to 32768, 0 for the default")
+	comparator := f.String("comparator", "", "key order of a new database: bytewise, reverse, case-insensitive")
+	if !f.parse(args, 3) {
+		return exitUsage
+	}
+	return exitCode("set", func() error {
+		key, err := f.keyEnc.decode(f.Arg(1))
+		if err != nil {
+			return fmt.Errorf("bad key: %w", err)
+		}
+		val, err := f.valEnc.decode(f.Arg(2))
+		if err != nil {
+			return fmt.Errorf("bad value: %w", err)
+		}
+		db, err := createDB(f.Arg(0), *pageSize, *comparator)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		return db.Set(key, val)
+	}())
+}
+
+// kv del <file> <key>
+func cmdDel(args []string) int {
+	f := newDataFlags("del", "<file> <key>")
+	if !f.parse(args, 2) {
+		return exitUsage
+	}
+	return exitCode("del", func() error {
+		key, err := f.keyEnc.decode(f.Arg(1))
+		if err != nil {
+			return fmt.Errorf("bad key: %w", err)
+		}
+		db, err := openDB(f.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		deleted, err := db.Del(key)
+		if err != nil {
+			return err
+		}
+		if !deleted {
+			return errNotFound
+		}
+		return nil
+	}())
+}
+
+// range flags of scan and count
+type rangeFlags struct {
+	*dataFlags
+	from  string
+	to    string
+	limit int
+}
+
+func newRangeFlags(name string) *rangeFlags {
+	f := &rangeFlags{dataFlags: newDataFlags(name, "<file>")}
+	f.StringVar(&f.from, "from", "", "the first key (inclusive)")
+	f.StringVar(&f.to, "to", "", "the last key (exclusive), empty for no bound")
+	f.IntVar(&f.limit, "limit", 0, "maximum number of keys, 0 for no limit")
+	return f
+}
+
+// iterate over the range, `fn` is called for every KV pair
+func (f *rangeFlags) scan(fn func(key, val []byte)) error {
+	from, err := f.keyEnc.decode(f.from)
+	if err != nil {
+		return fmt.Errorf("bad --from key: %w", err)
+	}
+	var to []byte
+	if f.to != "" {
+		if to, err = f.keyEnc.decode(f.to); err != nil {
+			return fmt.Errorf("bad --to key: %w", err)
+		}
+	}
+	db, err := openReadOnly(f.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	sc, err := db.Scan(from, to)
+	if err != nil {
+		return err
+	}
+	defer sc.Close()
+	for n := 0; sc.Valid() && (f.limit <= 0 || n < f.limit); n++ {
+		val, err := sc.Val()
+		if err != nil {
+			return err
+		}
+		fn(sc.Key(), val)
+		if err = sc.Next(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// kv scan [--from key] [--to key] [--limit n] <file>
+func cmdScan(args []string) int {
+	f := newRangeFlags("scan")
+	if !f.parse(args, 1) {
+		return exitUsage
+	}
+	return exitCode("scan", f.scan(func(key, val []byte) {
+		fmt.Fprintf(stdout, "%s\t%s\n", f.keyEnc.encode(key), f.valEnc.encode(val))
+	}))
+}
+
+// kv count [--from key] [--to key] <file>
+func cmdCount(args []string) int {
+	f := newRangeFlags("count")
+	if !f.parse(args, 1) {
+		return exitUsage
+	}
+	n := 0
+	err := f.scan(func(key, val []byte) {
+		n++
+	})
+	if err == nil {
+		fmt.Fprintln(stdout, n)
+	}
+	return exitCode("count", err)
+}
+
+// kv stats <file>
+func cmdStats(args []string) int {
+	f := newDataFlags("stats", "<file>")
+	if !f.parse(args, 1) {
+		return exitUsage
+	}
+	return exitCode("stats", func() error {
+		db, err := openReadOnly(f.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		stats := db.Stats()
+		fmt.Fprintf(stdout, "page size:  %d\n", stats.PageSize)
+		fmt.Fprintf(stdout, "pages:      %d\n", stats.Pages)
+		fmt.Fprintf(stdout, "free pages: %d\n", stats.FreePages)
+		fmt.Fprintf(stdout, "file size:  %d\n", stats.Pages*uint64(stats.PageSize))
+		fmt.Fprintf(stdout, "version:    %d\n", stats.Version)
+		fmt.Fprintf(stdout, "comparator: %s\n", stats.Comparator)
+		return nil
+	}())
+}
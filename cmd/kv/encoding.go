@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+)
+
+// how keys and values are passed on the command line and printed
+type encoding string
+
+const (
+	encRaw    encoding = "raw"
+	encHex    encoding = "hex"
+	encBase64 encoding = "base64"
+)
+
+func (e *encoding) String() string {
+	return string(*e)
+}
+
+func (e *encoding) Set(s string) error {
+	switch encoding(s) {
+	case encRaw, encHex, encBase64:
+		*e = encoding(s)
+		return nil
+	}
+	return fmt.Errorf("unknown encoding %q, must be one of raw, hex, base64", s)
+}
+
+func (e encoding) decode(s string) ([]byte, error) {
+	switch e {
+	case encHex:
+		return hex.DecodeString(s)
+	case encBase64:
+		return base64.StdEncoding.DecodeString(s)
+	}
+	return []byte(s), nil
+}
+
+func (e encoding) encode(data []byte) string {
+	switch e {
+	case encHex:
+		return hex.EncodeToString(data)
+	case encBase64:
+		return base64.StdEncoding.EncodeToString(data)
+	}
+	return string(data)
+}
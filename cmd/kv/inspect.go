@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/vansilich/db/internal/kv"
+	"github.com/vansilich/db/pkg/btree"
+)
+
+const inspectUsage = `usage: kv inspect <what> [flags] <file> [arguments]
+
+  page <file> <n>       decode a page as a B+tree node
+  meta <file>           decode both slots of the meta page
+  tree [--dot] <file>   print the B+tree from the root, as a Graphviz graph with --dot
+`
+
+// kv inspect page|meta|tree ...
+//
+// The file is read directly, without `KV.Open`, so damaged files can be inspected too.
+func cmdInspect(args []string) int {
+	var cmds = map[string]func(args []string) int{
+		"page": cmdInspectPage,
+		"meta": cmdInspectMeta,
+		"tree": cmdInspectTree,
+	}
+	if len(args) < 1 {
+		fmt.Fprint(stderr, inspectUsage)
+		return exitUsage
+	}
+	run, ok := cmds[args[0]]
+	if !ok {
+		fmt.Fprintf(stderr, "kv inspect: unknown command %q\n\n%s", args[0], inspectUsage)
+		return exitUsage
+	}
+	return run(args[1:])
+}
+
+// kv inspect page <file> <n>
+func cmdInspectPage(args []string) int {
+	if len(args) != 2 {
+		fmt.Fprintln(stderr, "usage: kv inspect page <file> <n>")
+		return exitUsage
+	}
+	ptr, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		fmt.Fprintf(stderr, "kv inspect: bad page number %q\n", args[1])
+		return exitUsage
+	}
+	return exitCode("inspect", withFile(args[0], func(fp *os.File) error {
+		if ptr == 0 {
+			return errors.New(`page 0 is the meta page, see "kv inspect meta"`)
+		}
+		page, stored, computed, err := kv.ReadPage(fp, ptr, filePageSize(fp))
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(stdout, "page:     %d\n", ptr)
+		fmt.Fprintf(stdout, "checksum: %08x (%s)\n", stored, checksumStatus(stored, computed))
+		if next, data, err := btree.DumpOverflow(page); err == nil {
+			fmt.Fprintln(stdout, "type:     OVERFLOW")
+			fmt.Fprintf(stdout, "next:     %d\n", next)
+			printBytes("data", data)
+			return nil
+		}
+		dump, err := btree.DumpNode(page)
+		if err != nil {
+			// a free list node, an unused page or garbage
+			fmt.Fprintf(stdout, "not a B+tree node: %s\n\n", err.Error())
+			fmt.Fprint(stdout, hex.Dump(page[:64]))
+			return nil
+		}
+		fmt.Fprintf(stdout, "type:     %s\n", nodeType(dump.Type))
+		fmt.Fprintf(stdout, "nkeys:    %d\n", dump.NKeys)
+		fmt.Fprintf(stdout, "offsets:  %v\n", dump.Offsets)
+		for i := range dump.Keys {
+			fmt.Fprintf(stdout, "\n[%d] offset %d\n", i, dump.Offsets[i])
+			if dump.Type == btree.BNODE_NODE {
+				fmt.Fprintf(stdout, "  ptr: %d\n", dump.Ptrs[i])
+			}
+			printBytes("key", dump.Keys[i])
+			if dump.Type == btree.BNODE_LEAF && dump.Ptrs[i] != 0 && len(dump.Vals[i]) == 8 {
+				fmt.Fprintf(stdout, "  val: %d bytes in overflow pages from page %d\n",
+					binary.LittleEndian.Uint64(dump.Vals[i]), dump.Ptrs[i])
+			} else if dump.Type == btree.BNODE_LEAF {
+				printBytes("val", dump.Vals[i])
+			}
+		}
+		return nil
+	}))
+}
+
+// kv inspect meta <file>
+func cmdInspectMeta(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(stderr, "usage: kv inspect meta <file>")
+		return exitUsage
+	}
+	return exitCode("inspect", withFile(args[0], func(fp *os.File) error {
+		slots, err := kv.ReadMetaSlots(fp)
+		if err != nil {
+			return err
+		}
+		newest := kv.NewestMetaSlot(slots)
+		for i, slot := range slots {
+			if i > 0 {
+				fmt.Fprintln(stdout)
+			}
+			status := "valid"
+			if slot.Err != nil {
+				status = slot.Err.Error()
+			} else if &slots[i] == newest {
+				status = "valid, current"
+			}
+			fmt.Fprintf(stdout, "slot %d at offset %d: %s\n", i, slot.Offset, status)
+			if slot.Err != nil {
+				fmt.Fprint(stdout, hex.Dump(slot.Data))
+				continue
+			}
+			fmt.Fprintf(stdout, "  version:    %d\n", slot.Version)
+			fmt.Fprintf(stdout, "  page size:  %d\n", slot.PageSize)
+			fmt.Fprintf(stdout, "  comparator: %s\n", slot.Comparator)
+			fmt.Fprintf(stdout, "  root:       %d\n", slot.Root)
+			fmt.Fprintf(stdout, "  pages used: %d\n", slot.Pages)
+			fmt.Fprintf(stdout, "  free list:  head %d (seq %d), tail %d (seq %d)\n",
+				slot.Free.HeadPage, slot.Free.HeadSeq, slot.Free.TailPage, slot.Free.TailSeq)
+		}
+		return nil
+	}))
+}
+
+// kv inspect tree [--dot] <file>
+func cmdInspectTree(args []string) int {
+	f := flag.NewFlagSet("inspect tree", flag.ContinueOnError)
+	f.SetOutput(stderr)
+	dot := f.Bool("dot", false, "print a Graphviz graph")
+	f.Usage = func() {
+		fmt.Fprint(stderr, "usage: kv inspect tree [flags] <file>\n\nflags:\n")
+		f.PrintDefaults()
+	}
+	if err := f.Parse(args); err != nil {
+		return exitUsage
+	}
+	if f.NArg() != 1 {
+		f.Usage()
+		return exitUsage
+	}
+	return exitCode("inspect", withFile(f.Arg(0), func(fp *os.File) error {
+		slots, err := kv.ReadMetaSlots(fp)
+		if err != nil {
+			return err
+		}
+		meta := kv.NewestMetaSlot(slots)
+		if meta == nil {
+			return errors.New("no valid meta page slot")
+		}
+
+		w := treeWalker{fp: fp, pages: meta.Pages, pageSize: meta.PageSize, seen: map[uint64]bool{}}
+		if *dot {
+			fmt.Fprintln(stdout, "digraph btree {")
+			fmt.Fprintln(stdout, "  node [shape=record, fontname=monospace];")
+		}
+		if meta.Root != 0 {
+			w.walk(meta.Root, 0, *dot)
+		}
+		if *dot {
+			fmt.Fprintln(stdout, "}")
+		}
+		return nil
+	}))
+}
+
+// walks the tree depth first, printing every node
+type treeWalker struct {
+	fp       *os.File
+	pages    uint64 // the number of pages in use
+	pageSize int
+	seen     map[uint64]bool // don't loop on a damaged tree
+}
+
+func (w *treeWalker) walk(ptr uint64, depth int, dot bool) {
+	indent := strings.Repeat("  ", depth)
+	dump, err := w.read(ptr)
+	if err != nil {
+		if dot {
+			fmt.Fprintf(stdout, "  p%d [label=\"page %d\\n%s\", color=red];\n", ptr, ptr, dotEscape(err.Error()))
+		} else {
+			fmt.Fprintf(stdout, "%spage %d: %s\n", indent, ptr, err.Error())
+		}
+		return
+	}
+
+	if dump.Type == btree.BNODE_LEAF {
+		first, last := dump.Keys[0], dump.Keys[len(dump.Keys)-1]
+		if dot {
+			fmt.Fprintf(stdout, "  p%d [label=\"page %d\\n%d keys\\n%s .. %s\"];\n",
+				ptr, ptr, dump.NKeys, dotEscape(shortText(first)), dotEscape(shortText(last)))
+		} else {
+			fmt.Fprintf(stdout, "%spage %d: LEAF, %d keys, %s .. %s\n",
+				indent, ptr, dump.NKeys, shortText(first), shortText(last))
+		}
+		return
+	}
+
+	if dot {
+		fields := []string{fmt.Sprintf("page %d", ptr)}
+		for i, key := range dump.Keys {
+			fields = append(fields, fmt.Sprintf("<k%d> %s", i, dotEscape(shortText(key))))
+		}
+		fmt.Fprintf(stdout, "  p%d [label=\"%s\"];\n", ptr, strings.Join(fields, " | "))
+		for i, kid := range dump.Ptrs {
+			fmt.Fprintf(stdout, "  p%d:k%d -> p%d;\n", ptr, i, kid)
+		}
+	} else {
+		fmt.Fprintf(stdout, "%spage %d: NODE, %d keys\n", indent, ptr, dump.NKeys)
+	}
+	for i, kid := range dump.Ptrs {
+		if !dot {
+			fmt.Fprintf(stdout, "%s  %s ->\n", indent, shortText(dump.Keys[i]))
+		}
+		w.walk(kid, depth+2, dot)
+	}
+}
+
+func (w *treeWalker) read(ptr uint64) (btree.NodeDump, error) {
+	if ptr == 0 || ptr >= w.pages {
+		return btree.NodeDump{}, errors.New("pointer is out of range")
+	}
+	if w.seen[ptr] {
+		return btree.NodeDump{}, errors.New("already visited")
+	}
+	w.seen[ptr] = true
+
+	page, stored, computed, err := kv.ReadPage(w.fp, ptr, w.pageSize)
+	if err != nil {
+		return btree.NodeDump{}, err
+	}
+	if stored != computed {
+		return btree.NodeDump{}, errors.New("checksum mismatch")
+	}
+	return btree.DumpNode(page)
+}
+
+// the page size from the meta page, the default one if the meta page is damaged
+func filePageSize(fp *os.File) int {
+	slots, err := kv.ReadMetaSlots(fp)
+	if err != nil {
+		return btree.BTREE_PAGE_SIZE
+	}
+	if meta := kv.NewestMetaSlot(slots); meta != nil {
+		return meta.PageSize
+	}
+	fmt.Fprintf(stderr, "kv inspect: no valid meta page slot, assuming the page size %d\n", btree.BTREE_PAGE_SIZE)
+	return btree.BTREE_PAGE_SIZE
+}
+
+// open a file for reading and run `fn` on it
+func withFile(path string, fn func(fp *os.File) error) error {
+	fp, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	return fn(fp)
+}
+
+func nodeType(t uint16) string {
+	switch t {
+	case btree.BNODE_NODE:
+		return "NODE (internal)"
+	case btree.BNODE_LEAF:
+		return "LEAF"
+	default:
+		return fmt.Sprintf("unknown %d", t)
+	}
+}
+
+func checksumStatus(stored, computed uint32) string {
+	if stored == computed {
+		return "ok"
+	}
+	return fmt.Sprintf("mismatch, computed %08x", computed)
+}
+
+// print a key or a value in hex and as text
+func printBytes(name string, data []byte) {
+	fmt.Fprintf(stdout, "  %s: %d bytes\n", name, len(data))
+	fmt.Fprintf(stdout, "    hex:  %s\n", hex.EncodeToString(data))
+	fmt.Fprintf(stdout, "    text: %s\n", strconv.Quote(string(data)))
+}
+
+// a quoted and truncated key for one-line output
+func shortText(data []byte) string {
+	const limit = 24
+	if len(data) > limit {
+		return strconv.Quote(string(data[:limit])) + "..."
+	}
+	return strconv.Quote(string(data))
+}
+
+// escape a string for a Graphviz record label
+func dotEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`\"{}|<> `, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
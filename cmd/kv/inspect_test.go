@@ -0,0 +1,109 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files")
+
+func TestInspectPageMeta(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	runCases(t, []cmdCase{
+		{"set a", cmdSet, []string{path, "a", "1"}, exitOK, ""},
+		{"set b", cmdSet, []string{path, "b", "2"}, exitOK, ""},
+
+		{"meta", cmdInspect, []string{"meta", path}, exitOK, `slot 0 at offset 0: valid, current
+  version:    2
+  page size:  4096
+  comparator: bytewise
+  root:       3
+  pages used: 4
+  free list:  head 1 (seq 0), tail 1 (seq 1)
+
+slot 1 at offset 2048: valid
+  version:    1
+  page size:  4096
+  comparator: bytewise
+  root:       2
+  pages used: 3
+  free list:  head 1 (seq 0), tail 1 (seq 0)
+`},
+		{"page", cmdInspect, []string{"page", path, "3"}, exitOK, `page:     3
+checksum: 71898e9f (ok)
+type:     LEAF
+nkeys:    3
+offsets:  [0 4 10 16]
+
+[0] offset 0
+  key: 0 bytes
+    hex:  
+    text: ""
+  val: 0 bytes
+    hex:  
+    text: ""
+
+[1] offset 4
+  key: 1 bytes
+    hex:  61
+    text: "a"
+  val: 1 bytes
+    hex:  31
+    text: "1"
+
+[2] offset 10
+  key: 1 bytes
+    hex:  62
+    text: "b"
+  val: 1 bytes
+    hex:  32
+    text: "2"
+`},
+		{"tree", cmdInspect, []string{"tree", path}, exitOK, "page 3: LEAF, 3 keys, \"\" .. \"b\"\n"},
+
+		{"meta page", cmdInspect, []string{"page", path, "0"}, exitFailure, ""},
+		{"bad page number", cmdInspect, []string{"page", path, "x"}, exitUsage, ""},
+		{"missing file", cmdInspect, []string{"meta", path + ".missing"}, exitFailure, ""},
+		{"unknown command", cmdInspect, []string{"pages", path}, exitUsage, ""},
+	})
+}
+
+func TestInspectTreeDot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := createDB(path, 0, "")
+	if err != nil {
+		t.Fatalf("open: %s", err.Error())
+	}
+	// a few leaves under the root
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key_%02d", i)
+		if err := db.Set([]byte(key), []byte(strings.Repeat("v", 500))); err != nil {
+			t.Fatalf("KV.Set: %s", err.Error())
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("KV.Close: %s", err.Error())
+	}
+
+	code, out, errOut := runCmd(t, cmdInspect, "tree", "--dot", path)
+	if code != exitOK {
+		t.Fatalf("exit code %d: %s", code, errOut)
+	}
+	golden := filepath.Join("testdata", "tree.dot")
+	if *update {
+		if err := os.WriteFile(golden, []byte(out), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != string(want) {
+		t.Fatalf("output:\n%s\nwant:\n%s", out, want)
+	}
+}
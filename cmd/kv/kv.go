@@ -1,4 +1,68 @@
 package main
 
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+const usage = `usage: kv <command> [flags] <file> [arguments]
+
+commands:
+  get <file> <key>            print the value of a key
+  set <file> <key> <value>    set the value of a key
+  del <file> <key>            delete a key
+  scan [flags] <file>         print the KV pairs in a key range
+  count [flags] <file>        count the keys in a key range
+  stats <file>                print database statistics
+  shell <file>                run commands interactively
+  check <file>                verify the database file
+  inspect <what> <file>       decode pages, the meta page or the tree
+  backup <src> <dst>          copy a snapshot to a new file, also while it's written
+  compact <file>              rewrite the database without free pages
+
+run "kv <command> -h" for the flags of a command. the flags of the data
+commands may also follow the arguments.
+`
+
+// exit codes
+const (
+	exitOK       = 0
+	exitFailure  = 1 // an error or a failed check
+	exitUsage    = 2
+	exitNotFound = 3 // get or del of a missing key
+)
+
+// the output of the commands, replaced by the tests
+var (
+	stdout io.Writer = os.Stdout
+	stderr io.Writer = os.Stderr
+)
+
 func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(stderr, usage)
+		os.Exit(exitUsage)
+	}
+
+	var cmds = map[string]func(args []string) int{
+		"get":     cmdGet,
+		"set":     cmdSet,
+		"del":     cmdDel,
+		"scan":    cmdScan,
+		"count":   cmdCount,
+		"stats":   cmdStats,
+		"check":   cmdCheck,
+		"shell":   cmdShell,
+		"inspect": cmdInspect,
+		"backup":  cmdBackup,
+		"compact": cmdCompact,
+	}
+	cmd, args := os.Args[1], os.Args[2:]
+	run, ok := cmds[cmd]
+	if !ok {
+		fmt.Fprintf(stderr, "kv: unknown command %q\n\n%s", cmd, usage)
+		os.Exit(exitUsage)
+	}
+	os.Exit(run(args))
 }
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// run a command with the output captured
+func runCmd(t *testing.T, cmd func(args []string) int, args ...string) (int, string, string) {
+	t.Helper()
+	var out, errOut bytes.Buffer
+	oldOut, oldErr := stdout, stderr
+	stdout, stderr = &out, &errOut
+	defer func() {
+		stdout, stderr = oldOut, oldErr
+	}()
+	code := cmd(args)
+	return code, out.String(), errOut.String()
+}
+
+type cmdCase struct {
+	name string
+	cmd  func(args []string) int
+	args []string
+	code int
+	out  string
+}
+
+func runCases(t *testing.T, cases []cmdCase) {
+	t.Helper()
+	for _, c := range cases {
+		code, out, errOut := runCmd(t, c.cmd, c.args...)
+		if code != c.code {
+			t.Fatalf("%s: exit code %d, want %d, stderr: %s", c.name, code, c.code, errOut)
+		}
+		if out != c.out {
+			t.Fatalf("%s: output %q, want %q", c.name, out, c.out)
+		}
+	}
+}
+
+func TestCmdData(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.db")
+	missing := filepath.Join(dir, "missing.db")
+
+	runCases(t, []cmdCase{
+		{"set a", cmdSet, []string{path, "a", "1"}, exitOK, ""},
+		{"set b", cmdSet, []string{path, "b", "2"}, exitOK, ""},
+		{"set c", cmdSet, []string{path, "c", "3"}, exitOK, ""},
+		{"set d", cmdSet, []string{path, "d", "4"}, exitOK, ""},
+		{"get", cmdGet, []string{path, "a"}, exitOK, "1\n"},
+		{"get a missing key", cmdGet, []string{path, "x"}, exitNotFound, ""},
+		{"del a missing key", cmdDel, []string{path, "x"}, exitNotFound, ""},
+		{"get a missing file", cmdGet, []string{missing, "a"}, exitFailure, ""},
+		{"del a missing file", cmdDel, []string{missing, "a"}, exitFailure, ""},
+		{"get without a key", cmdGet, []string{path}, exitUsage, ""},
+		{"set without a value", cmdSet, []string{path, "a"}, exitUsage, ""},
+		{"unknown flag", cmdGet, []string{"--bad", path, "a"}, exitUsage, ""},
+		{"unknown encoding", cmdGet, []string{"--key-encoding", "rot13", path, "a"}, exitUsage, ""},
+
+		// encodings
+		{"set hex", cmdSet, []string{"--key-encoding", "hex", "--value-encoding", "hex", path, "6b", "ff00"}, exitOK, ""},
+		{"get raw", cmdGet, []string{"--value-encoding", "hex", path, "k"}, exitOK, "ff00\n"},
+		{"get base64", cmdGet, []string{"--value-encoding", "base64", path, "k"}, exitOK, "/wA=\n"},
+		{"set base64", cmdSet, []string{"--key-encoding", "base64", path, "ZQ==", "5"}, exitOK, ""},
+		{"get hex", cmdGet, []string{"--key-encoding", "hex", path, "65"}, exitOK, "5\n"},
+		{"flags after the arguments", cmdGet, []string{path, "65", "--key-encoding", "hex"}, exitOK, "5\n"},
+		{"bad hex key", cmdGet, []string{"--key-encoding", "hex", path, "zz"}, exitFailure, ""},
+		{"bad base64 value", cmdSet, []string{"--value-encoding", "base64", path, "a", "!"}, exitFailure, ""},
+		{"del", cmdDel, []string{path, "e"}, exitOK, ""},
+		{"get deleted", cmdGet, []string{path, "e"}, exitNotFound, ""},
+
+		// ranges
+		{"scan", cmdScan, []string{path}, exitOK, "a\t1\nb\t2\nc\t3\nd\t4\nk\t\xff\x00\n"},
+		{"scan hex", cmdScan, []string{"--key-encoding", "hex", "--value-encoding", "hex", "--limit", "1", path}, exitOK, "61\t31\n"},
+		{"scan from to", cmdScan, []string{"--from", "b", "--to", "d", path}, exitOK, "b\t2\nc\t3\n"},
+		{"scan limit", cmdScan, []string{path, "--from", "c", "--limit", "2"}, exitOK, "c\t3\nd\t4\n"},
+		{"scan empty", cmdScan, []string{path, "--from", "x"}, exitOK, ""},
+		{"scan without a file", cmdScan, []string{"--from", "a"}, exitUsage, ""},
+		{"count", cmdCount, []string{path}, exitOK, "5\n"},
+		{"count from", cmdCount, []string{path, "--from", "b"}, exitOK, "4\n"},
+		{"count from to", cmdCount, []string{"--from", "b", "--to", "k", path}, exitOK, "3\n"},
+		{"count limit", cmdCount, []string{"--limit", "2", path}, exitOK, "2\n"},
+		{"count a missing file", cmdCount, []string{missing}, exitFailure, ""},
+
+		{"stats", cmdStats, []string{path}, exitOK, "page size:  4096\n" +
+			"pages:      4\n" +
+			"free pages: 1\n" +
+			"file size:  16384\n" +
+			"version:    7\n" +
+			"comparator: bytewise\n"},
+		{"stats without a file", cmdStats, nil, exitUsage, ""},
+	})
+}
+
+func TestCmdSetOptions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	runCases(t, []cmdCase{
+		{"unknown comparator", cmdSet, []string{"--comparator", "random", path, "a", "1"}, exitFailure, ""},
+		{"set b", cmdSet, []string{"--page-size", "8192", "--comparator", "reverse", path, "b", "2"}, exitOK, ""},
+		{"set a", cmdSet, []string{path, "a", "1"}, exitOK, ""},
+		{"scan", cmdScan, []string{path}, exitOK, "b\t2\na\t1\n"},
+	})
+	_, out, _ := runCmd(t, cmdStats, path)
+	if !strings.Contains(out, "page size:  8192\n") || !strings.Contains(out, "comparator: reverse\n") {
+		t.Fatalf("stats: %q", out)
+	}
+}
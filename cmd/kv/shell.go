@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vansilich/db/internal/kv"
+	"golang.org/x/term"
+)
+
+const shellHelp = `commands:
+  get <key>                    print the value of a key
+  set <key> <value>            set the value of a key
+  del <key>                    delete a key
+  scan [from [to [limit]]]     print the KV pairs in a key range, "-" for no bound
+  begin                        begin a transaction
+  commit                       commit the transaction
+  abort                        abort the transaction
+  help                         print this help
+  exit                         leave the shell, an open transaction is aborted
+`
+
+// operations of both the database and a transaction
+type kvOps interface {
+	Get(key []byte) ([]byte, bool, error)
+	Set(key []byte, val []byte) error
+	Del(key []byte) (bool, error)
+	Scan(start, end []byte) (*kv.Scanner, error)
+}
+
+type shell struct {
+	db     *kv.KV
+	tx     *kv.KVTX // the open transaction, if any
+	out    io.Writer
+	keyEnc encoding
+	valEnc encoding
+}
+
+var errExit = errors.New("exit")
+
+var shellCmds = map[string]func(sh *shell, args []string) error{
+	"get":    (*shell).get,
+	"set":    (*shell).set,
+	"del":    (*shell).del,
+	"scan":   (*shell).scan,
+	"begin":  (*shell).begin,
+	"commit": (*shell).commit,
+	"abort":  (*shell).abort,
+	"help":   (*shell).help,
+	"exit":   (*shell).exit,
+	"quit":   (*shell).exit,
+}
+
+// kv shell <file>
+func cmdShell(args []string) int {
+	f := newDataFlags("shell", "<file>")
+	if !f.parse(args, 1) {
+		return exitUsage
+	}
+	db, err := openDB(f.Arg(0))
+	if err != nil {
+		return exitCode("shell", err)
+	}
+	defer db.Close()
+
+	sh := &shell{db: db, keyEnc: f.keyEnc, valEnc: f.valEnc}
+	defer func() {
+		if sh.tx != nil {
+			sh.tx.Abort()
+		}
+	}()
+
+	// a terminal gets line editing, history and completion;
+	// otherwise commands are read line by line, e.g. from a script.
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		sh.out = stdout
+		return exitCode("shell", sh.script(os.Stdin))
+	}
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return exitCode("shell", err)
+	}
+	defer term.Restore(fd, state)
+
+	t := term.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout}, "kv> ")
+	t.AutoCompleteCallback = completeCommand
+	sh.out = t
+	for {
+		line, err := t.ReadLine()
+		if err == io.EOF {
+			return exitOK
+		}
+		if err != nil {
+			return exitCode("shell", err)
+		}
+		if errors.Is(sh.exec(line), errExit) {
+			return exitOK
+		}
+	}
+}
+
+// run the commands line by line until the end or "exit"
+func (sh *shell) script(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if errors.Is(sh.exec(scanner.Text()), errExit) {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
+
+// run a command line and print its result and timing
+func (sh *shell) exec(line string) error {
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		return nil
+	}
+	run, ok := shellCmds[args[0]]
+	if !ok {
+		fmt.Fprintf(sh.out, "unknown command %q, try \"help\"\n", args[0])
+		return nil
+	}
+
+	start := time.Now()
+	err := run(sh, args[1:])
+	if errors.Is(err, errExit) {
+		return err
+	}
+	if err != nil {
+		fmt.Fprintf(sh.out, "error: %s\n", err.Error())
+	}
+	fmt.Fprintf(sh.out, "(%s)\n", time.Since(start))
+	return nil
+}
+
+// the transaction if it's open, the database otherwise
+func (sh *shell) ops() kvOps {
+	if sh.tx != nil {
+		return sh.tx
+	}
+	return sh.db
+}
+
+func (sh *shell) get(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: get <key>")
+	}
+	key, err := sh.keyEnc.decode(args[0])
+	if err != nil {
+		return fmt.Errorf("bad key: %w", err)
+	}
+	val, found, err := sh.ops().Get(key)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return errNotFound
+	}
+	fmt.Fprintln(sh.out, sh.valEnc.encode(val))
+	return nil
+}
+
+func (sh *shell) set(args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: set <key> <value>")
+	}
+	key, err := sh.keyEnc.decode(args[0])
+	if err != nil {
+		return fmt.Errorf("bad key: %w", err)
+	}
+	val, err := sh.valEnc.decode(args[1])
+	if err != nil {
+		return fmt.Errorf("bad value: %w", err)
+	}
+	return sh.ops().Set(key, val)
+}
+
+func (sh *shell) del(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: del <key>")
+	}
+	key, err := sh.keyEnc.decode(args[0])
+	if err != nil {
+		return fmt.Errorf("bad key: %w", err)
+	}
+	deleted, err := sh.ops().Del(key)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return errNotFound
+	}
+	return nil
+}
+
+func (sh *shell) scan(args []string) error {
+	if len(args) > 3 {
+		return errors.New("usage: scan [from [to [limit]]]")
+	}
+	// optional arguments, "-" for no bound
+	var bounds [2][]byte
+	for i := 0; i < len(args) && i < 2; i++ {
+		if args[i] == "-" {
+			continue
+		}
+		key, err := sh.keyEnc.decode(args[i])
+		if err != nil {
+			return fmt.Errorf("bad key: %w", err)
+		}
+		bounds[i] = key
+	}
+	limit := 0
+	if len(args) == 3 {
+		n, err := strconv.Atoi(args[2])
+		if err != nil {
+			return fmt.Errorf("bad limit: %w", err)
+		}
+		limit = n
+	}
+
+	sc, err := sh.ops().Scan(bounds[0], bounds[1])
+	if err != nil {
+		return err
+	}
+	defer sc.Close()
+	n := 0
+	for ; sc.Valid() && (limit <= 0 || n < limit); n++ {
+		val, err := sc.Val()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(sh.out, "%s\t%s\n", sh.keyEnc.encode(sc.Key()), sh.valEnc.encode(val))
+		if err = sc.Next(); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(sh.out, "%d keys\n", n)
+	return nil
+}
+
+func (sh *shell) begin(args []string) error {
+	if sh.tx != nil {
+		return errors.New("a transaction is already open")
+	}
+	sh.tx = sh.db.Begin()
+	return nil
+}
+
+func (sh *shell) commit(args []string) error {
+	if sh.tx == nil {
+		return errors.New("no open transaction")
+	}
+	tx := sh.tx
+	sh.tx = nil
+	return tx.Commit()
+}
+
+func (sh *shell) abort(args []string) error {
+	if sh.tx == nil {
+		return errors.New("no open transaction")
+	}
+	sh.tx.Abort()
+	sh.tx = nil
+	return nil
+}
+
+func (sh *shell) help(args []string) error {
+	fmt.Fprint(sh.out, shellHelp)
+	return nil
+}
+
+func (sh *shell) exit(args []string) error {
+	return errExit
+}
+
+// complete the command name on tab
+func completeCommand(line string, pos int, key rune) (string, int, bool) {
+	if key != '\t' || strings.ContainsRune(line[:pos], ' ') {
+		return "", 0, false
+	}
+	prefix := line[:pos]
+	var matches []string
+	for name := range shellCmds {
+		if strings.HasPrefix(name, prefix) {
+			matches = append(matches, name)
+		}
+	}
+	if len(matches) == 0 {
+		return "", 0, false
+	}
+	sort.Strings(matches)
+	// the longest common prefix of the matches
+	common := matches[0]
+	for _, name := range matches[1:] {
+		for !strings.HasPrefix(name, common) {
+			common = common[:len(common)-1]
+		}
+	}
+	if len(matches) == 1 {
+		common += " "
+	}
+	return common + line[pos:], len(common), true
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// the timing printed after every command
+var timingLine = regexp.MustCompile(`(?m)^\(.*\)\n`)
+
+func TestShellScript(t *testing.T) {
+	db, err := createDB(filepath.Join(t.TempDir(), "test.db"), 0, "")
+	if err != nil {
+		t.Fatalf("open: %s", err.Error())
+	}
+	defer db.Close()
+
+	script := `set a 1
+begin
+set b 2
+get b
+abort
+get b
+begin
+set c 3
+del a
+commit
+scan
+
+bogus
+commit
+get
+scan - - x
+exit
+set z 9
+`
+	var out bytes.Buffer
+	sh := &shell{db: db, out: &out, keyEnc: encRaw, valEnc: encRaw}
+	if err := sh.script(strings.NewReader(script)); err != nil {
+		t.Fatalf("script: %s", err.Error())
+	}
+	want := `2
+error: key not found
+c	3
+1 keys
+unknown command "bogus", try "help"
+error: no open transaction
+error: usage: get <key>
+error: bad limit: strconv.Atoi: parsing "x": invalid syntax
+`
+	if got := timingLine.ReplaceAllString(out.String(), ""); got != want {
+		t.Fatalf("output:\n%s\nwant:\n%s", got, want)
+	}
+	if sh.tx != nil {
+		t.Fatalf("a transaction is open after commit")
+	}
+
+	// the aborted and the deleted keys are gone, nothing runs after "exit"
+	for key, want := range map[string]string{"a": "", "b": "", "c": "3", "z": ""} {
+		val, found, err := db.Get([]byte(key))
+		if err != nil {
+			t.Fatalf("KV.Get: %s", err.Error())
+		}
+		if found != (want != "") || string(val) != want {
+			t.Fatalf("KV.Get(%s) = %q, %v, want %q", key, val, found, want)
+		}
+	}
+}
+
+func TestShellComplete(t *testing.T) {
+	cases := []struct {
+		line string
+		pos  int
+		key  rune
+		out  string
+		ok   bool
+	}{
+		{"ge", 2, '\t', "get ", true},
+		{"co", 2, '\t', "commit ", true},
+		{"s", 1, '\t', "s", true}, // set or scan
+		{"", 0, '\t', "", true},   // all commands
+		{"q", 1, '\t', "quit ", true},
+		{"cox", 2, '\t', "commit x", true},
+		{"x", 1, '\t', "", false},
+		{"get a", 5, '\t', "", false}, // only the command name
+		{"ge", 2, 'a', "", false},
+	}
+	for _, c := range cases {
+		out, pos, ok := completeCommand(c.line, c.pos, c.key)
+		if ok != c.ok || out != c.out {
+			t.Fatalf("completeCommand(%q, %d) = %q, %v, want %q, %v", c.line, c.pos, out, ok, c.out, c.ok)
+		}
+		if ok && pos != len(strings.TrimSuffix(c.out, c.line[c.pos:])) {
+			t.Fatalf("completeCommand(%q, %d): position %d", c.line, c.pos, pos)
+		}
+	}
+}
@@ -2,4 +2,7 @@ module github.com/vansilich/db
 
 go 1.20
 
-require golang.org/x/sys v0.20.0 // indirect
+require (
+	golang.org/x/sys v0.20.0
+	golang.org/x/term v0.19.0
+)
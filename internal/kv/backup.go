@@ -0,0 +1,141 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/vansilich/db/pkg/btree"
+	"github.com/vansilich/db/pkg/freelist"
+)
+
+// write a consistent snapshot of the latest commit as a new database file.
+// only the pages reachable from the root are copied, renumbered in key
+// order after the meta page and an empty free list node, so the result
+// is compact and can be opened directly. writers are not blocked, the
+// snapshot is pinned like a `KVReader`.
+func (db *KV) Backup(w io.Writer) error {
+	r := db.BeginRead()
+	defer r.End()
+	if _, err := writeSnapshot(w, db, &r.tree, r.version); err != nil {
+		return fmt.Errorf("KV.Backup: %w", err)
+	}
+	return nil
+}
+
+// a commit reused the pages of the snapshot, see `BackupFile`
+var ErrBackupChanged = errors.New("the database was changed during the backup")
+
+// write a snapshot of a database file that another process may have opened
+// for writes, like `KV.Backup` does in that process. the file is not locked:
+// the snapshot is the commit of the on-disk meta page, its pages are not
+// reused until the meta page is updated. it fails with ErrBackupChanged
+// if that happened during the backup, the output must be discarded and
+// the backup can be retried. the commits of `SyncPeriodic` and the log
+// since the last sync or checkpoint are not included.
+func BackupFile(path string, w io.Writer) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("BackupFile: %w", err)
+	}
+	defer f.Close()
+
+	db := &KV{}
+	version, err := fileMeta(f, db)
+	if err != nil {
+		return fmt.Errorf("BackupFile: %w", err)
+	}
+	db.tree.Get = fileView{file: f, npages: db.page.flushed, size: db.page.size}.read
+	_, err = writeSnapshot(w, db, &db.tree, version)
+
+	// the pages read are valid while the meta page is the same
+	if now, e := fileMeta(f, &KV{}); e != nil || now != version {
+		return fmt.Errorf("BackupFile: %w", ErrBackupChanged)
+	}
+	if err != nil {
+		return fmt.Errorf("BackupFile: %w", err)
+	}
+	return nil
+}
+
+// load the newest meta page of a file opened by `BackupFile`.
+// returns the version.
+func fileMeta(f *os.File, db *KV) (uint64, error) {
+	page := make([]byte, btree.BTREE_MIN_PAGE_SIZE) // the slots are within it
+	if _, err := f.ReadAt(page, 0); err != nil {
+		return 0, fmt.Errorf("read meta page: %w", err)
+	}
+	data, _, err := newestMeta(page)
+	if err != nil {
+		return 0, err
+	}
+	if err = loadMeta(db, data); err != nil {
+		return 0, err
+	}
+	setPageSize(db)
+	return db.version, nil
+}
+
+// the pages of a file written by another process, see `BackupFile`
+type fileView struct {
+	file   *os.File
+	npages uint64 // number of pages of the meta page
+	size   int    // page size
+}
+
+// read a page. panics with a `CorruptionError` like `pageView.read`.
+func (v fileView) read(ptr uint64) []byte {
+	if ptr == 0 || ptr >= v.npages {
+		panic(&CorruptionError{Page: ptr, Reason: "pointer is out of range"})
+	}
+	page := make([]byte, v.size)
+	if _, err := v.file.ReadAt(page, int64(ptr)*int64(v.size)); err != nil {
+		panic(&CorruptionError{Page: ptr, Reason: err.Error()})
+	}
+	if pageChecksum(page) != pageStoredChecksum(page) {
+		panic(&CorruptionError{Page: ptr, Reason: "checksum mismatch"})
+	}
+	return page
+}
+
+// write the tree as a new database file. returns the number of pages.
+func writeSnapshot(w io.Writer, db *KV, tree *btree.BTree, version uint64) (npages uint64, err error) {
+	defer recoverCorruption(&err)
+	// the pages after the meta page and the free list node
+	cp, err := tree.Copy(2)
+	if err != nil {
+		return 0, err
+	}
+
+	// the meta page, the same as a new database after a commit
+	snap := &KV{}
+	snap.tree.Root = cp.Root()
+	snap.page.size = db.page.size
+	snap.page.flushed = 2 + uint64(cp.Pages())
+	snap.free.PageSize = db.page.size
+	snap.free.LoadMeta(freelist.Meta{HeadPage: 1, TailPage: 1})
+	snap.version = version
+	snap.comparator = db.comparator
+	page := make([]byte, db.page.size)
+	copy(page, saveMeta(snap))
+	if _, err = w.Write(page); err != nil {
+		return 0, err
+	}
+	// the free list node
+	page = make([]byte, db.page.size)
+	pageSetChecksum(page)
+	if _, err = w.Write(page); err != nil {
+		return 0, err
+	}
+	// the tree
+	err = cp.Write(func(page []byte) error {
+		pageSetChecksum(page)
+		_, err := w.Write(page)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return snap.page.flushed, nil
+}
@@ -0,0 +1,74 @@
+package kv
+
+import (
+	"sort"
+
+	"github.com/vansilich/db/pkg/btree"
+)
+
+// a batch of updates applied by `KV.Write` or `KVTX.Write`
+type Batch struct {
+	ops []btree.Op
+}
+
+// the key and the value are copied
+func (b *Batch) Set(key, val []byte) {
+	b.ops = append(b.ops, btree.Op{
+		Key: append([]byte(nil), key...),
+		Val: append([]byte(nil), val...),
+	})
+}
+
+func (b *Batch) Del(key []byte) {
+	b.ops = append(b.ops, btree.Op{Key: append([]byte(nil), key...), Del: true})
+}
+
+// the number of updates
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+func (b *Batch) Reset() {
+	b.ops = b.ops[:0]
+}
+
+// apply a batch in a single commit
+func (db *KV) Write(b *Batch) error {
+	tx := db.Begin()
+	if err := tx.Write(b); err != nil {
+		tx.Abort()
+		return err
+	}
+	return tx.Commit()
+}
+
+// apply a batch in the transaction. the updates are sorted, so keys in
+// the same leaf share one copy of the path. a later update of a key wins.
+func (tx *KVTX) Write(b *Batch) (err error) {
+	if tx.done {
+		return tx.doneErr()
+	}
+	defer recoverCorruption(&err)
+	ops := sortOps(b.ops, tx.tree.Compare)
+	if err = tx.tree.Update(ops); err == nil {
+		tx.logOps(ops...)
+	}
+	return err
+}
+
+// sort the ops by key and remove the overwritten ones
+func sortOps(ops []btree.Op, compare func(a, b []byte) int) []btree.Op {
+	sorted := append([]btree.Op(nil), ops...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return compare(sorted[i].Key, sorted[j].Key) < 0
+	})
+	out := sorted[:0]
+	for _, op := range sorted {
+		if n := len(out); n > 0 && compare(out[n-1].Key, op.Key) == 0 {
+			out[n-1] = op // the later one
+			continue
+		}
+		out = append(out, op)
+	}
+	return out
+}
@@ -0,0 +1,60 @@
+package kv
+
+import (
+	"github.com/vansilich/db/pkg/btree"
+)
+
+// replaces the content of the database with KVs in sorted order.
+// the tree is built bottom-up in a write transaction and published
+// by a single `updateFile` on commit.
+type BulkLoader struct {
+	tx     *KVTX
+	loader *btree.BulkLoader
+}
+
+// start a bulk load, see `btree.BTree.BulkLoad` for the fill factor.
+// it blocks other writers until it's committed or aborted.
+func (db *KV) BulkLoad(fill float64) (*BulkLoader, error) {
+	tx := db.Begin()
+	if tx.done {
+		return nil, tx.doneErr()
+	}
+	loader, err := tx.tree.BulkLoad(fill)
+	if err != nil {
+		tx.Abort()
+		return nil, err
+	}
+	tx.nolog = true // too big for the log, committed by a checkpoint
+	return &BulkLoader{tx: tx, loader: loader}, nil
+}
+
+// add a KV, the keys must be in ascending order.
+// a rejected KV doesn't change the load.
+func (bl *BulkLoader) Add(key, val []byte) error {
+	if bl.tx.done {
+		return bl.tx.doneErr()
+	}
+	return bl.loader.Add(key, val)
+}
+
+// finish the tree and commit it
+func (bl *BulkLoader) Commit() (err error) {
+	if bl.tx.done {
+		return bl.tx.doneErr()
+	}
+	if err = bl.finish(); err != nil {
+		bl.tx.Abort()
+		return err
+	}
+	return bl.tx.Commit()
+}
+
+func (bl *BulkLoader) finish() (err error) {
+	defer recoverCorruption(&err) // the old tree is read to free it
+	return bl.loader.Finish()
+}
+
+// discard the load
+func (bl *BulkLoader) Abort() {
+	bl.tx.Abort()
+}
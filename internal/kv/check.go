@@ -0,0 +1,117 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/vansilich/db/pkg/btree"
+)
+
+// the result of `Check`
+type CheckResult struct {
+	Pages      uint64 // number of used pages, including the meta page
+	Version    uint64
+	Tree       btree.CheckStats
+	FreeNodes  uint64   // free list nodes
+	FreePages  uint64   // free list items
+	Leaked     []uint64 // pages that are neither reachable nor free
+	Violations []string
+}
+
+func (r *CheckResult) OK() bool {
+	return len(r.Leaked) == 0 && len(r.Violations) == 0
+}
+
+// owners of pages
+const (
+	pageUnused = iota
+	pageTree
+	pageFreeNode
+	pageFreeItem
+)
+
+var pageOwners = [...]string{"unused", "a tree node", "a free list node", "a free page"}
+
+// verify a database file offline: the tree structure from the meta page root,
+// the free list, and that every page is either reachable or free.
+func Check(path string) (*CheckResult, error) {
+	return CheckWith(path, btree.Comparator{})
+}
+
+// `Check` a database with a custom comparator, see `KV.Comparator`
+func CheckWith(path string, cmp btree.Comparator) (*CheckResult, error) {
+	finfo, err := os.Stat(path)
+	if err != nil {
+		return nil, err // don't create it
+	}
+	if finfo.Size() == 0 {
+		return &CheckResult{}, nil // nothing has been written yet
+	}
+	db := &KV{Path: path, NoVerify: true, Comparator: cmp} // checksums are verified below
+	if err := db.OpenReadOnly(); err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	res := &CheckResult{Pages: db.page.flushed, Version: db.version}
+	owners := make([]byte, db.page.flushed)
+	owners[0] = pageTree // the meta page
+	// mark a page as used, a page can't be used twice
+	use := func(ptr uint64, owner byte) error {
+		if ptr == 0 || ptr >= db.page.flushed {
+			return errors.New("pointer is out of range")
+		}
+		if owners[ptr] != pageUnused {
+			return fmt.Errorf("the page is already used as %s", pageOwners[owners[ptr]])
+		}
+		owners[ptr] = owner
+		return nil
+	}
+	verify := func(ptr uint64) error {
+		page := db.pageReadFile(ptr)
+		if pageChecksum(page) != pageStoredChecksum(page) {
+			return errors.New("checksum mismatch")
+		}
+		return nil
+	}
+
+	// the tree
+	stats, violations := db.tree.Check(func(ptr uint64) error {
+		if err := use(ptr, pageTree); err != nil {
+			return err
+		}
+		return verify(ptr)
+	})
+	res.Tree = stats
+	for _, v := range violations {
+		res.Violations = append(res.Violations, v.String())
+	}
+
+	// the free list
+	err = db.free.Walk(func(ptr uint64) error {
+		res.FreeNodes++
+		if err := use(ptr, pageFreeNode); err != nil {
+			return fmt.Errorf("page %d: %w", ptr, err)
+		}
+		if err := verify(ptr); err != nil {
+			return fmt.Errorf("page %d: %w", ptr, err)
+		}
+		return nil
+	}, func(ptr uint64) {
+		res.FreePages++
+		if err := use(ptr, pageFreeItem); err != nil {
+			res.Violations = append(res.Violations, fmt.Sprintf("free page %d: %s", ptr, err.Error()))
+		}
+	})
+	if err != nil {
+		res.Violations = append(res.Violations, "free list: "+err.Error())
+	}
+
+	for ptr, owner := range owners {
+		if owner == pageUnused {
+			res.Leaked = append(res.Leaked, uint64(ptr))
+		}
+	}
+	return res, nil
+}
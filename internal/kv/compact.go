@@ -0,0 +1,241 @@
+package kv
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"syscall"
+)
+
+// the file before and after a compaction
+type CompactStats struct {
+	PagesBefore uint64 // used pages, including the meta page
+	PagesAfter  uint64
+	SizeBefore  int64 // file size in bytes
+	SizeAfter   int64
+}
+
+// rewrite the live pages of the latest commit to a new file `dst` in key
+// order, then rename it over the database and continue with it. `dst` must
+// not exist and must be on the same file system. writers are blocked until
+// it's done, readers continue with the old file.
+func (db *KV) Compact(dst string) (CompactStats, error) {
+	if db.readonly {
+		return CompactStats{}, ErrReadOnly
+	}
+	db.writer.Lock()
+	defer db.writer.Unlock()
+
+	stats := CompactStats{PagesBefore: db.page.flushed}
+	var err error
+	if stats.SizeBefore, err = fileSize(db.fd); err != nil {
+		return stats, fmt.Errorf("KV.Compact: %w", err)
+	}
+	fd, err := writeCompacted(db, dst)
+	if err != nil {
+		_ = os.Remove(dst)
+		return stats, fmt.Errorf("KV.Compact: %w", err)
+	}
+	if err = renameSync(dst, db.Path); err != nil {
+		_ = syscall.Close(fd)
+		_ = os.Remove(dst)
+		return stats, fmt.Errorf("KV.Compact: %w", err)
+	}
+	if err = switchFile(db, fd); err != nil {
+		return stats, fmt.Errorf("KV.Compact: %w", err)
+	}
+
+	stats.PagesAfter = db.page.flushed
+	if stats.SizeAfter, err = fileSize(db.fd); err != nil {
+		return stats, fmt.Errorf("KV.Compact: %w", err)
+	}
+	return stats, nil
+}
+
+// write the tree to a new file, it's synced and locked. returns the fd.
+func writeCompacted(db *KV, dst string) (int, error) {
+	f, err := os.OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return -1, err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	if _, err = writeSnapshot(w, db, &db.tree, db.version); err != nil {
+		return -1, err
+	}
+	if err = w.Flush(); err != nil {
+		return -1, err
+	}
+	if err = f.Sync(); err != nil {
+		return -1, err
+	}
+	// the lock belongs to the open file, it's shared by the duplicate
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		return -1, fmt.Errorf("dup: %w", err)
+	}
+	if err = lockFile(fd, true, 0); err != nil {
+		_ = syscall.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+// rename a file and sync the directory
+func renameSync(src, dst string) error {
+	if err := os.Rename(src, dst); err != nil {
+		return err
+	}
+	dir, err := os.Open(path.Dir(dst))
+	if err != nil {
+		return fmt.Errorf("open directory: %w", err)
+	}
+	defer dir.Close()
+	if err = dir.Sync(); err != nil {
+		return fmt.Errorf("fsync directory: %w", err)
+	}
+	return nil
+}
+
+// continue with the compacted file. the old mmaps are kept until the
+// readers of the old file end, the old file is closed.
+func switchFile(db *KV, fd int) error {
+	old := db.mmap.chunks
+	db.mmap.chunks = nil
+	db.mmap.total = 0
+	_ = syscall.Close(db.fd) // the database is in the new file
+	db.fd = fd
+	discardPages(db)
+	db.page.dirty = nil // in the new file
+	db.page.dropped = nil
+	db.page.reusable = nil
+	db.failed = false
+	db.sync.pending = false
+	err := openFile(db)
+
+	db.reader.mu.Lock()
+	db.mmap.retired = append(db.mmap.retired, retiredMmap{file: db.reader.file, chunks: old})
+	if err == nil {
+		// new readers use the new file
+		db.reader.file++
+		publishLocked(db)
+	}
+	unmapRetired(db)
+	db.reader.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if db.wal.file != nil {
+		return resetLog(db) // the commits in it are in the new file
+	}
+	return nil
+}
+
+// the mmaps of a file before `Compact`
+type retiredMmap struct {
+	file   uint64
+	chunks [][]byte
+}
+
+// unmap the old files without readers, the caller holds `db.reader.mu`
+func unmapRetired(db *KV) {
+	kept := db.mmap.retired[:0]
+	for _, old := range db.mmap.retired {
+		if old.file == db.reader.file || db.reader.files[old.file] > 0 {
+			kept = append(kept, old)
+			continue
+		}
+		for _, chunk := range old.chunks {
+			_ = syscall.Munmap(chunk) // the pages are not used
+		}
+	}
+	db.mmap.retired = kept
+}
+
+// remove the free pages at the end of the file. the free list is drained
+// and the pages before the new end are added back, then the file is
+// truncated after a commit. pages visible to readers are kept.
+func (db *KV) CompactInPlace() (CompactStats, error) {
+	tx := db.Begin()
+	if tx.done {
+		return CompactStats{}, tx.doneErr()
+	}
+	defer db.writer.Unlock()
+	tx.done = true
+
+	stats := CompactStats{PagesBefore: db.page.flushed}
+	var err error
+	if stats.SizeBefore, err = fileSize(db.fd); err != nil {
+		return stats, fmt.Errorf("KV.CompactInPlace: %w", err)
+	}
+	// the pages freed by commits not in the meta page can't be reused yet
+	if err = syncMeta(db); err != nil {
+		return stats, fmt.Errorf("KV.CompactInPlace: %w", err)
+	}
+	// the checkpoint may update the free list
+	tx.meta = saveMeta(db)
+	db.free.SetVersions(db.version+1, minReaderVersion(db))
+
+	if err = truncateFree(db); err != nil {
+		revertMeta(db, tx.meta)
+		discardPages(db)
+		return stats, fmt.Errorf("KV.CompactInPlace: %w", err)
+	}
+	db.version++
+	if err = updateOrRevert(db, tx.meta, SyncFull); err != nil {
+		return stats, fmt.Errorf("KV.CompactInPlace: %w", err)
+	}
+	publish(db)
+	// the pages after the end are not referenced by the meta page
+	size := int64(db.page.flushed) * int64(db.page.size)
+	if err = syscall.Ftruncate(db.fd, size); err != nil {
+		return stats, fmt.Errorf("KV.CompactInPlace: truncate: %w", err)
+	}
+
+	stats.PagesAfter = db.page.flushed
+	if stats.SizeAfter, err = fileSize(db.fd); err != nil {
+		return stats, fmt.Errorf("KV.CompactInPlace: %w", err)
+	}
+	return stats, nil
+}
+
+// move the end of the file before the trailing free pages
+func truncateFree(db *KV) (err error) {
+	defer recoverCorruption(&err)
+	free := map[uint64]bool{}
+	for ptr := db.free.PopHead(); ptr != 0; ptr = db.free.PopHead() {
+		if ptr >= db.page.flushed {
+			return fmt.Errorf("free page %d is out of range", ptr)
+		}
+		free[ptr] = true
+	}
+	end := db.page.flushed
+	if db.page.nappend == 0 { // a list node appended while draining stays at the end
+		for end > 2 && free[end-1] {
+			end--
+		}
+	}
+	// new list nodes are appended after the new end
+	db.page.flushed = end
+	kept := make([]uint64, 0, len(free))
+	for ptr := range free {
+		if ptr < end {
+			kept = append(kept, ptr)
+		}
+	}
+	sort.Slice(kept, func(i, j int) bool { return kept[i] < kept[j] })
+	for _, ptr := range kept {
+		db.free.PushTail(ptr)
+	}
+	return nil
+}
+
+func fileSize(fd int) (int64, error) {
+	var finfo syscall.Stat_t
+	if err := syscall.Fstat(fd, &finfo); err != nil {
+		return 0, fmt.Errorf("stat: %w", err)
+	}
+	return finfo.Size, nil
+}
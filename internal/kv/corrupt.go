@@ -0,0 +1,26 @@
+package kv
+
+import "fmt"
+
+// a damaged page is found in the file
+type CorruptionError struct {
+	Page   uint64 // page number
+	Reason string
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("page %d is corrupted: %s", e.Page, e.Reason)
+}
+
+// page callbacks of `BTree` and `FreeList` can't return errors, so a damaged
+// page is reported by a panic. it's converted back to an error here.
+// usage: `defer recoverCorruption(&err)` in a function with a named result.
+func recoverCorruption(err *error) {
+	if r := recover(); r != nil {
+		cerr, ok := r.(*CorruptionError)
+		if !ok {
+			panic(r)
+		}
+		*err = cerr
+	}
+}
@@ -0,0 +1,178 @@
+package kv
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/vansilich/db/pkg/btree"
+)
+
+// the maximum number of updates in a group commit
+const GROUP_MAX_OPS = 1024
+
+var ErrClosed = errors.New("the database is closed")
+
+// a `KV.Set` or `KV.Del` waiting for a group commit
+type commitReq struct {
+	op   btree.Op
+	done chan commitRes
+}
+
+type commitRes struct {
+	deleted bool
+	err     error
+}
+
+// start the commit goroutine
+func startGroup(db *KV) {
+	db.group.closed = false
+	db.group.reqs = make(chan commitReq, GROUP_MAX_OPS)
+	db.group.done = make(chan struct{})
+	go func() {
+		defer close(db.group.done)
+		for req := range db.group.reqs {
+			commitGroup(db, collectGroup(db, req))
+		}
+	}()
+}
+
+// stop the commit goroutine after the queued updates are committed
+func stopGroup(db *KV) {
+	if db.group.reqs == nil {
+		return
+	}
+	db.group.mu.Lock()
+	db.group.closed = true
+	close(db.group.reqs)
+	db.group.mu.Unlock()
+	<-db.group.done
+	db.group.reqs = nil
+}
+
+// queue an update and wait for the commit
+func groupUpdate(db *KV, op btree.Op) (bool, error) {
+	req := commitReq{op: op, done: make(chan commitRes, 1)}
+	db.group.mu.RLock()
+	if db.group.closed {
+		db.group.mu.RUnlock()
+		return false, ErrClosed
+	}
+	db.group.reqs <- req
+	db.group.mu.RUnlock()
+	res := <-req.done
+	return res.deleted, res.err
+}
+
+// wait up to `GroupDelay` for more updates to join the 1st one
+func collectGroup(db *KV, first commitReq) []commitReq {
+	group := []commitReq{first}
+	var timeout <-chan time.Time
+	if db.GroupDelay > 0 {
+		timer := time.NewTimer(db.GroupDelay)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for len(group) < GROUP_MAX_OPS {
+		if timeout == nil {
+			// no delay: take what is already queued
+			select {
+			case req, ok := <-db.group.reqs:
+				if !ok {
+					return group
+				}
+				group = append(group, req)
+				continue
+			default:
+				return group
+			}
+		}
+		select {
+		case req, ok := <-db.group.reqs:
+			if !ok {
+				return group
+			}
+			group = append(group, req)
+		case <-timeout:
+			return group
+		}
+	}
+	return group
+}
+
+// apply a group of updates in one tree update and one `updateFile`.
+// every caller gets its own result; an invalid update fails alone,
+// a failed commit fails all the others.
+func commitGroup(db *KV, group []commitReq) {
+	valid := make([]commitReq, 0, len(group))
+	for _, req := range group {
+		op := req.op
+		if op.Del && (len(op.Key) == 0 || len(op.Key) > btree.BTREE_MAX_KEY_SIZE) {
+			req.done <- commitRes{} // the dummy key or a key that can't exist
+			continue
+		}
+		if err := btree.CheckKV(op.Key, op.Val); err != nil {
+			req.done <- commitRes{err: err}
+			continue
+		}
+		valid = append(valid, req)
+	}
+	if len(valid) == 0 {
+		return
+	}
+
+	tx := db.Begin()
+	deleted, err := groupApply(tx, valid)
+	if err != nil {
+		tx.Abort()
+	} else {
+		err = tx.Commit()
+	}
+	for i, req := range valid {
+		if err != nil {
+			req.done <- commitRes{err: err}
+		} else {
+			req.done <- commitRes{deleted: deleted[i]}
+		}
+	}
+}
+
+// apply the updates in the transaction, the results of deletions are
+// computed as if the updates were applied one by one in order.
+func groupApply(tx *KVTX, group []commitReq) (deleted []bool, err error) {
+	defer recoverCorruption(&err)
+	order := make([]int, len(group))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return tx.tree.Compare(group[order[i]].op.Key, group[order[j]].op.Key) < 0
+	})
+
+	deleted = make([]bool, len(group))
+	ops := make([]btree.Op, 0, len(group))
+	for i := 0; i < len(order); {
+		key := group[order[i]].op.Key
+		_, exists, err := tx.tree.Lookup(key)
+		if err != nil {
+			return nil, err
+		}
+		// the updates of the same key, the last one wins
+		j := i
+		for ; j < len(order) && tx.tree.Compare(group[order[j]].op.Key, key) == 0; j++ {
+			if op := group[order[j]].op; op.Del {
+				deleted[order[j]] = exists
+				exists = false
+			} else {
+				exists = true
+			}
+		}
+		ops = append(ops, group[order[j-1]].op)
+		i = j
+	}
+	if err = tx.tree.Update(ops); err != nil {
+		return nil, err
+	}
+	tx.logOps(ops...)
+	return deleted, nil
+}
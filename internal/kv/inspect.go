@@ -0,0 +1,70 @@
+package kv
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/vansilich/db/pkg/btree"
+	"github.com/vansilich/db/pkg/freelist"
+)
+
+// Raw access to a database file for debugging tools. unlike `KV.Open`,
+// it works on damaged files.
+
+// a decoded slot of the meta page
+type MetaSlot struct {
+	Offset     int
+	Data       []byte // the raw slot
+	Err        error  // the slot is not valid
+	Root       uint64
+	Pages      uint64
+	Free       freelist.Meta
+	Version    uint64
+	PageSize   int
+	Comparator string
+}
+
+// decode both slots of the meta page
+func ReadMetaSlots(f io.ReaderAt) ([]MetaSlot, error) {
+	page := make([]byte, btree.BTREE_MIN_PAGE_SIZE) // the slots are within it
+	if _, err := f.ReadAt(page, 0); err != nil {
+		return nil, fmt.Errorf("read meta page: %w", err)
+	}
+
+	slots := make([]MetaSlot, 0, META_SLOTS)
+	for i := 0; i < META_SLOTS; i++ {
+		slot := MetaSlot{Offset: i * META_SLOT_OFFSET}
+		slot.Data = page[slot.Offset:][:META_SIZE_IN_BYTES]
+		var db KV
+		if slot.Err = loadMeta(&db, slot.Data); slot.Err == nil {
+			slot.Root = db.tree.Root
+			slot.Pages = db.page.flushed
+			slot.Free = db.free.SaveMeta()
+			slot.Version = db.version
+			slot.PageSize = db.page.size
+			slot.Comparator = db.comparator
+		}
+		slots = append(slots, slot)
+	}
+	return slots, nil
+}
+
+// the newest valid slot, nil if there is none
+func NewestMetaSlot(slots []MetaSlot) *MetaSlot {
+	var newest *MetaSlot
+	for i := range slots {
+		if slots[i].Err == nil && (newest == nil || slots[i].Version > newest.Version) {
+			newest = &slots[i]
+		}
+	}
+	return newest
+}
+
+// read a page with its stored and computed checksums
+func ReadPage(f io.ReaderAt, ptr uint64, pageSize int) (page []byte, stored uint32, computed uint32, err error) {
+	page = make([]byte, pageSize)
+	if _, err = f.ReadAt(page, int64(ptr)*int64(pageSize)); err != nil {
+		return nil, 0, 0, fmt.Errorf("read page %d: %w", ptr, err)
+	}
+	return page, pageStoredChecksum(page), pageChecksum(page), nil
+}
@@ -4,10 +4,11 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"sort"
 	"syscall"
 
-	"github.com/vansilich/db/pkg/btree"
 	"github.com/vansilich/db/pkg/compare"
+	"golang.org/x/sys/unix"
 )
 
 func createFileSync(file string) (int, error) {
@@ -32,21 +33,40 @@ func createFileSync(file string) (int, error) {
 	return fd, nil
 }
 
-// Update the meta page. it must be atomic.
+// Update the meta page. the slot of the previous update is left intact,
+// so a torn write of the meta page falls back to it.
 func updateRoot(db *KV) error {
-	if _, err := syscall.Pwrite(db.fd, saveMeta(db), 0); err != nil {
+	slot := (db.metaSlot + 1) % META_SLOTS
+	if err := writeMetaSlot(db, saveMeta(db), slot); err != nil {
+		return err
+	}
+	db.metaSlot = slot
+	return nil
+}
+
+func writeMetaSlot(db *KV, meta []byte, slot uint64) error {
+	if _, err := syscall.Pwrite(db.fd, meta, int64(slot*META_SLOT_OFFSET)); err != nil {
 		return fmt.Errorf("write meta page: %w", err)
 	}
 	return nil
 }
 
-func updateFile(db *KV) error {
+func updateFile(db *KV, mode SyncMode) error {
 	// 1. Write new nodes.
+	if err := writeDirty(db); err != nil {
+		return err
+	}
 	if err := writePages(db); err != nil {
 		return err
 	}
+	if mode == SyncPeriodic {
+		// the meta page is updated by the next `syncMeta`,
+		// freed pages are not reused until then.
+		db.sync.pending = true
+		return nil
+	}
 	// 2. `fsync` to enforce the order between 1 and 3.
-	if err := syscall.Fsync(db.fd); err != nil {
+	if err := fileSync(db, mode); err != nil {
 		return err
 	}
 	// 3. Update the root pointer atomically.
@@ -54,9 +74,11 @@ func updateFile(db *KV) error {
 		return err
 	}
 	// 4. `fsync` to make everything persistent.
-	if err := syscall.Fsync(db.fd); err != nil {
+	if err := fileSync(db, mode); err != nil {
 		return err
 	}
+	// pages freed by this update can be reused by the next one
+	synced(db)
 	return nil
 }
 
@@ -76,23 +98,55 @@ func extendMmap(db *KV, size int) error {
 		return fmt.Errorf("mmap: %w", err)
 	}
 	db.mmap.total += alloc
+	// readers take a copy of the chunk list, see `publish`
+	db.reader.mu.Lock()
 	db.mmap.chunks = append(db.mmap.chunks, chunk)
+	db.reader.mu.Unlock()
 	return nil
 }
 
+// the maximum number of buffers of a `pwritev`
+const IOV_MAX = 1024
+
 func writePages(db *KV) error {
 	// extend the mmap if needed
-	size := (int(db.page.flushed) + len(db.page.temp)) * btree.BTREE_PAGE_SIZE
+	size := int(db.page.flushed+db.page.nappend) * db.page.size
 	if err := extendMmap(db, size); err != nil {
 		return err
 	}
-	// write data pages to the file
-	offset := int64(db.page.flushed * btree.BTREE_PAGE_SIZE)
-	if _, err := unix.Pwritev(db.fd, db.page.temp, offset); err != nil {
+	if err := pwritePages(db, db.page.updates); err != nil {
 		return err
 	}
 	// discard in-memory data
-	db.page.flushed += uint64(len(db.page.temp))
-	db.page.temp = db.page.temp[:0]
+	db.page.flushed += db.page.nappend
+	db.page.nappend = 0
+	db.page.updates = map[uint64][]byte{}
+	return nil
+}
+
+// write pages to the file, adjacent pages are written at once
+func pwritePages(db *KV, pages map[uint64][]byte) error {
+	ptrs := make([]uint64, 0, len(pages))
+	for ptr := range pages {
+		ptrs = append(ptrs, ptr)
+	}
+	sort.Slice(ptrs, func(i, j int) bool { return ptrs[i] < ptrs[j] })
+	for i := 0; i < len(ptrs); {
+		j := i + 1
+		for j < len(ptrs) && ptrs[j] == ptrs[j-1]+1 && j-i < IOV_MAX {
+			j++
+		}
+		run := make([][]byte, 0, j-i)
+		for _, ptr := range ptrs[i:j] {
+			page := pages[ptr]
+			pageSetChecksum(page)
+			run = append(run, page)
+		}
+		offset := int64(ptrs[i]) * int64(db.page.size)
+		if _, err := unix.Pwritev(db.fd, run, offset); err != nil {
+			return err
+		}
+		i = j
+	}
 	return nil
 }
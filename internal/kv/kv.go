@@ -1,7 +1,11 @@
 package kv
 
 import (
+	"fmt"
+	"os"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/vansilich/db/pkg/btree"
 	"github.com/vansilich/db/pkg/freelist"
@@ -17,88 +21,402 @@ import (
 //		   	  +---------------------------------------+
 
 type KV struct {
-	Path string // file name
+	Path     string // file name
+	NoVerify bool   // skip page checksum verification on reads
+	// page size of a new database, 0 means btree.BTREE_PAGE_SIZE. a power
+	// of 2 from 4K to 32K: the 16-bit offsets of the node format can't
+	// address a node of 2 pages of 64K, which it can be before a split.
+	// an existing database uses the page size in its meta page.
+	PageSize int
+	// the order of keys, the zero value means btree.Bytewise for a new database
+	// and the built-in comparator recorded in the meta page for an existing one.
+	Comparator btree.Comparator
+	// coalesce concurrent `Set` and `Del` calls into one commit.
+	// a group waits up to `GroupDelay` for more updates after the 1st one.
+	GroupCommit bool
+	GroupDelay  time.Duration
+	// the durability of commits, a transaction can override it.
+	// `SyncPeriodic` syncs every `SyncInterval`, 0 means SYNC_INTERVAL.
+	Sync         SyncMode
+	SyncInterval time.Duration
+	// commit by appending to a write-ahead log, the meta page is updated by
+	// a checkpoint when the log reaches `CheckpointSize`, 0 means WAL_CHECKPOINT_SIZE.
+	WAL            bool
+	CheckpointSize int64
+	// how long `Open` waits for another process to release the database,
+	// 0 means failing immediately with ErrLocked.
+	LockTimeout time.Duration
 	// internals
-	fd   int
-	tree btree.BTree
-	free freelist.FreeList
-	mmap struct {
-		total  int      // mmap size, can be larger than the file size
-		chunks [][]byte // multiple mmaps, can be non-continuous
+	readonly bool // opened by `OpenReadOnly`
+	fd       int
+	tree     btree.BTree
+	free     freelist.FreeList
+	mmap     struct {
+		total   int           // mmap size, can be larger than the file size
+		chunks  [][]byte      // multiple mmaps, can be non-continuous
+		retired []retiredMmap // mmaps of the files before `Compact`, used by readers
 	}
 	page struct {
-		flushed uint64   // database size in number of pages
-		temp    [][]byte // newly allocated pages
+		size    int               // page size in bytes
+		flushed uint64            // database size in number of pages
+		nappend uint64            // number of pages to be appended
+		updates map[uint64][]byte // pending updates, including appended pages
+		// the pages of the logged commits, written by the next checkpoint.
+		// the dirty pages freed by them are not in the free list until then.
+		dirty    *dirtyPages
+		freed    []uint64      // dirty pages freed by the pending update
+		dropped  []droppedPage // freed by the logged commits, still visible
+		reusable []uint64      // freed and not visible to readers anymore
+		nreused  int           // reusable pages taken by the pending update
+	}
+	failed     bool   // Did the last update fail?
+	version    uint64 // monotonic commit counter
+	comparator string // the name of the key order
+	metaSlot   uint64 // the meta slot of the last update
+	// concurrency
+	writer sync.Mutex // serializes write transactions
+	reader struct {
+		mu      sync.Mutex
+		root    uint64         // the latest committed tree root
+		version uint64         // and its version
+		view    pageView       // the mmap view of the committed version
+		active  map[uint64]int // number of open readers per version
+		file    uint64         // the file of the view, counted by `Compact`
+		files   map[uint64]int // number of open readers per file
+	}
+	group struct {
+		mu     sync.RWMutex // guards `closed` against sends on a closed channel
+		closed bool
+		reqs   chan commitReq // pending updates
+		done   chan struct{}  // closed when the commit goroutine exits
+	}
+	sync struct {
+		pending bool          // commits not in the on-disk meta page yet
+		stop    chan struct{} // stops the background sync
+		done    chan struct{} // closed when the background sync exits
+	}
+	wal struct {
+		file  *os.File // the log, nil without `WAL`
+		size  int64    // the end of the last record
+		stale bool     // the log was not emptied after the last checkpoint
 	}
-	failed bool // Did the last update fail?
 }
 
 func (db *KV) Open() error {
-	db.tree.Get = db.pageRead   // read a page
-	db.tree.New = db.pageAppend // apppend a page
-	db.tree.Del = func(uint64) {}
+	db.readonly = false
+	return db.open()
+}
+
+// open an existing database for reads only. the file is not created or
+// written, so it can be on a read-only mount. updates fail with ErrReadOnly.
+// other processes can read it, but not write it until it's closed.
+func (db *KV) OpenReadOnly() error {
+	db.readonly = true
+	return db.open()
+}
+
+func (db *KV) open() error {
+	if err := checkSyncMode(db.Sync); err != nil {
+		return fmt.Errorf("KV.Open: %w", err)
+	}
+	// open or create the DB file
+	var fd int
+	var err error
+	if db.readonly {
+		if fd, err = syscall.Open(db.Path, syscall.O_RDONLY, 0); err != nil {
+			err = fmt.Errorf("open file: %w", err)
+		}
+	} else {
+		fd, err = createFileSync(db.Path)
+	}
+	if err != nil {
+		return fmt.Errorf("KV.Open: %w", err)
+	}
+	db.fd = fd
+	// the log is covered by the lock too
+	if err = lockFile(fd, !db.readonly, db.LockTimeout); err != nil {
+		_ = db.Close()
+		return fmt.Errorf("KV.Open: %w", err)
+	}
+
+	db.page.updates = map[uint64][]byte{}
+	db.tree.Get = db.pageRead  // read a page
+	db.tree.New = db.pageAlloc // (new) reuse from the free list or append
+	db.tree.Del = db.pageFree  // (new) freed pages go to the free list
 	// free list callbacks
 	db.free.Get = db.pageRead   // read a page
 	db.free.New = db.pageAppend // append a page
 	db.free.Set = db.pageWrite  // (new) in-place updates
+
+	if err = openFile(db); err != nil {
+		_ = db.Close()
+		return fmt.Errorf("KV.Open: %w", err)
+	}
+	db.reader.active = map[uint64]int{}
+	db.reader.files = map[uint64]int{}
+	publish(db)
+	if db.readonly {
+		if err = checkLog(db); err != nil {
+			_ = db.Close()
+			return fmt.Errorf("KV.Open: %w", err)
+		}
+		return nil // no background writers
+	}
+	// the commits in the log are replayed in any mode
+	if err = openLog(db); err != nil {
+		_ = db.Close()
+		return fmt.Errorf("KV.Open: %w", err)
+	}
+	if db.GroupCommit {
+		startGroup(db)
+	}
+	if db.Sync == SyncPeriodic {
+		startSyncer(db)
+	}
 	return nil
 }
 
-func (db *KV) Get(key []byte) ([]byte, bool) {
-	return db.tree.Get(key), true
+// map the opened file and load the meta page
+func openFile(db *KV) error {
+	// get the file size
+	var finfo syscall.Stat_t
+	if err := syscall.Fstat(db.fd, &finfo); err != nil {
+		return fmt.Errorf("stat: %w", err)
+	}
+	fileSize := finfo.Size
+	// the page size is unknown until the meta page is read, but it's
+	// always a multiple of the minimum page size.
+	if fileSize%btree.BTREE_MIN_PAGE_SIZE != 0 {
+		return fmt.Errorf("file size %d is not a multiple of the page size", fileSize)
+	}
+	// create the initial mmap
+	if err := extendMmap(db, int(fileSize)); err != nil {
+		return err
+	}
+	// read the meta page
+	return readRoot(db, fileSize)
+}
+
+// unmap the file and close it
+func (db *KV) Close() error {
+	stopGroup(db)
+	err := stopSyncer(db)
+	chunks := db.mmap.chunks
+	for _, old := range db.mmap.retired {
+		chunks = append(chunks, old.chunks...)
+	}
+	for _, chunk := range chunks {
+		if e := syscall.Munmap(chunk); e != nil && err == nil {
+			err = fmt.Errorf("munmap: %w", e)
+		}
+	}
+	db.mmap.total = 0
+	db.mmap.chunks = nil
+	db.mmap.retired = nil
+
+	if db.wal.file != nil {
+		if e := db.wal.file.Close(); e != nil && err == nil {
+			err = fmt.Errorf("close log: %w", e)
+		}
+		db.wal.file = nil
+	}
+
+	// the lock is released with the file
+	if e := syscall.Close(db.fd); e != nil && err == nil {
+		err = fmt.Errorf("close file: %w", e)
+	}
+	db.fd = -1
+	return err
+}
+
+// read the latest committed value. the result is a copy.
+func (db *KV) Get(key []byte) ([]byte, bool, error) {
+	r := db.BeginRead()
+	defer r.End()
+
+	val, found, err := r.Get(key)
+	if err != nil || !found {
+		return nil, found, err
+	}
+	return append([]byte(nil), val...), true, nil
 }
 
 func (db *KV) Set(key []byte, val []byte) error {
-	meta := saveMeta(db) // save the in-memory state (tree root)
-	if err := db.tree.Insert(key, val); err != nil {
+	if db.readonly {
+		return ErrReadOnly
+	}
+	if db.GroupCommit {
+		_, err := groupUpdate(db, btree.Op{Key: key, Val: val})
+		return err
+	}
+	tx := db.Begin()
+	if err := tx.Set(key, val); err != nil {
+		tx.Abort()
 		return err
 	}
-	return updateOrRevert(db, meta)
+	return tx.Commit()
 }
 
 func (db *KV) Del(key []byte) (bool, error) {
-	deleted, err := db.tree.Delete(key)
-	if err != nil {
+	if db.readonly {
+		return false, ErrReadOnly
+	}
+	if db.GroupCommit {
+		return groupUpdate(db, btree.Op{Key: key, Del: true})
+	}
+	tx := db.Begin()
+	deleted, err := tx.Del(key)
+	if err != nil || !deleted {
+		tx.Abort()
 		return false, err
 	}
-	return deleted, updateFile(db)
+	return true, tx.Commit()
 }
 
 func readRoot(db *KV, fileSize int64) error {
 	if fileSize == 0 { // empty file
-		db.page.flushed = 1 // the meta page is initialized on the 1st write
-		return nil
+		db.page.size = db.PageSize
+		if db.page.size == 0 {
+			db.page.size = btree.BTREE_PAGE_SIZE
+		}
+		if err := btree.CheckPageSize(db.page.size); err != nil {
+			return err
+		}
+		setPageSize(db)
+		db.tree.Cmp = db.Comparator
+		db.comparator = db.tree.Comparator().Name
+		if db.comparator == "" || len(db.comparator) > META_COMPARATOR_SIZE {
+			return fmt.Errorf("bad comparator name %q", db.comparator)
+		}
+		// reserve 2 pages: the meta page and a free list node
+		db.page.flushed = 2
+		// add an initial node to the free list so it's never empty
+		db.free.LoadMeta(freelist.Meta{HeadPage: 1, TailPage: 1})
+		db.page.updates[1] = make([]byte, db.page.size)
+		return nil // the meta page is initialized on the 1st write
+	}
+	// read the newest valid slot of the meta page
+	newest, slot, err := newestMeta(db.mmap.chunks[0])
+	if err != nil {
+		return err
+	}
+	db.metaSlot = slot
+	if err = loadMeta(db, newest); err != nil {
+		return err
+	}
+	if db.PageSize != 0 && db.PageSize != db.page.size {
+		return fmt.Errorf("page size %d does not match the database page size %d", db.PageSize, db.page.size)
+	}
+	if fileSize%int64(db.page.size) != 0 {
+		return fmt.Errorf("file size %d is not a multiple of the page size %d", fileSize, db.page.size)
+	}
+	setPageSize(db)
+	if err = setComparator(db); err != nil {
+		return err
+	}
+	// verify the page
+	npages := uint64(fileSize / int64(db.page.size))
+	if db.page.flushed < 2 || db.page.flushed > npages {
+		return fmt.Errorf("bad meta page: %d pages used, file has %d", db.page.flushed, npages)
 	}
-	// read the page
-	data := db.mmap.chunks[0]
-	loadMeta(db, data)
+	if db.tree.Root >= db.page.flushed {
+		return fmt.Errorf("bad meta page: root pointer %d is out of range", db.tree.Root)
+	}
+	fm := db.free.SaveMeta()
+	if fm.HeadPage >= db.page.flushed || fm.TailPage >= db.page.flushed {
+		return fmt.Errorf("bad meta page: free list pointers %d, %d are out of range", fm.HeadPage, fm.TailPage)
+	}
+	return nil
+}
+
+// the page size is fixed once the database is opened
+func setPageSize(db *KV) {
+	db.tree.PageSize = db.page.size
+	db.free.PageSize = db.page.size
+}
+
+// use the key order recorded in the meta page
+func setComparator(db *KV) error {
+	cmp := db.Comparator
+	if cmp.Compare == nil {
+		builtin, ok := btree.ComparatorByName(db.comparator)
+		if !ok {
+			return fmt.Errorf("the database uses the comparator %q, it must be set in KV.Comparator", db.comparator)
+		}
+		cmp = builtin
+	}
+	if cmp.Name != db.comparator {
+		return fmt.Errorf("comparator %q does not match the database comparator %q", cmp.Name, db.comparator)
+	}
+	db.tree.Cmp = cmp
 	return nil
 }
 
-func updateOrRevert(db *KV, meta []byte) error {
-	// ensure the on-disk meta page matches the in-memory one after an error
+func updateOrRevert(db *KV, meta []byte, mode SyncMode) error {
+	// ensure the on-disk meta page matches the last successful update after an error.
+	// both slots are rewritten, the other one may have the failed update.
 	if db.failed {
-		if err := updateRoot(db); err != nil {
+		// the meta page references the pages kept by the log
+		if err := writeDirty(db); err != nil {
 			return err
 		}
+		// the pages of the last update may not be synced by `SyncPeriodic`
+		if err := syscall.Fsync(db.fd); err != nil {
+			return err
+		}
+		for slot := uint64(0); slot < META_SLOTS; slot++ {
+			if err := writeMetaSlot(db, meta, slot); err != nil {
+				return err
+			}
+		}
 
 		if err := syscall.Fsync(db.fd); err != nil {
 			return err
 		}
 
 		db.failed = false
+		db.sync.pending = false
+		// the pages freed by this update are not reusable until it's
+		// in the meta page, the limit of the last sync is kept.
 	}
 
-	err := updateFile(db)
+	// the pages dropped since the checkpoint are freed by this update
+	dropped, reusable := db.page.dropped, db.page.reusable
+	releaseDropped(db)
+	err := updateFile(db, mode)
 	if err != nil {
 		// the on-disk meta page is in an unknown state;
 		// mark it to be rewritten on later recovery.
 		db.failed = true
 		// the in-memory states can be reverted immediately to allow reads
-		loadMeta(db, meta)
+		revertMeta(db, meta)
 		// discard temporaries
-		db.page.temp = db.page.temp[:0]
+		discardPages(db)
+		db.page.dropped, db.page.reusable = dropped, reusable
 	}
 
 	return err
 }
+
+type Stats struct {
+	Pages      uint64 // number of used pages, including the meta page
+	FreePages  uint64 // pages in the free list
+	PageSize   int
+	Version    uint64 // the number of the last commit
+	Comparator string // the name of the key order
+}
+
+// statistics of the latest commit
+func (db *KV) Stats() Stats {
+	db.writer.Lock()
+	defer db.writer.Unlock()
+
+	fm := db.free.SaveMeta()
+	return Stats{
+		Pages:      db.page.flushed,
+		FreePages:  fm.TailSeq - fm.HeadSeq,
+		PageSize:   db.page.size,
+		Version:    db.version,
+		Comparator: db.comparator,
+	}
+}
@@ -0,0 +1,1545 @@
+package kv
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vansilich/db/pkg/btree"
+)
+
+func openTestKV(t *testing.T, path string) *KV {
+	t.Helper()
+	db := &KV{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatalf("KV.Open: %s", err.Error())
+	}
+	return db
+}
+
+func TestKVReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestKV(t, path)
+	for i := 0; i < 1000; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("key_%d", i)), []byte(fmt.Sprintf("val_%d", i))); err != nil {
+			t.Fatalf("KV.Set: %s", err.Error())
+		}
+	}
+	if _, err := db.Del([]byte("key_1")); err != nil {
+		t.Fatalf("KV.Del: %s", err.Error())
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("KV.Close: %s", err.Error())
+	}
+
+	db = openTestKV(t, path)
+	defer db.Close()
+	for i := 0; i < 1000; i++ {
+		val, found, err := db.Get([]byte(fmt.Sprintf("key_%d", i)))
+		if err != nil {
+			t.Fatalf("KV.Get: %s", err.Error())
+		}
+		if i == 1 {
+			if found {
+				t.Fatalf("KV.Get found a deleted key")
+			}
+			continue
+		}
+		if !found || string(val) != fmt.Sprintf("val_%d", i) {
+			t.Fatalf("KV.Get(key_%d) = %q, %v", i, val, found)
+		}
+	}
+}
+
+func TestKVOpenBadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	if err := os.WriteFile(path, []byte("not a database"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	db := &KV{Path: path}
+	if err := db.Open(); err == nil {
+		t.Fatalf("KV.Open accepted a bad file")
+	}
+}
+
+func TestKVReusePages(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestKV(t, path)
+	defer db.Close()
+
+	key := []byte("key")
+	for i := 0; i < 2000; i++ {
+		if err := db.Set(key, []byte(fmt.Sprintf("val_%d", i))); err != nil {
+			t.Fatalf("KV.Set: %s", err.Error())
+		}
+	}
+	// each update frees the old root, so the file stays small
+	if db.page.flushed > 10 {
+		t.Fatalf("pages are not reused: %d pages used", db.page.flushed)
+	}
+}
+
+func TestKVScan(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestKV(t, path)
+	defer db.Close()
+	for i := 0; i < 500; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("key_%03d", i)), []byte(fmt.Sprintf("val_%d", i))); err != nil {
+			t.Fatalf("KV.Set: %s", err.Error())
+		}
+	}
+
+	sc, err := db.Scan([]byte("key_100"), []byte("key_200"))
+	if err != nil {
+		t.Fatalf("KV.Scan: %s", err.Error())
+	}
+	defer sc.Close()
+	i := 100
+	for ; sc.Valid(); i++ {
+		if want := fmt.Sprintf("key_%03d", i); string(sc.Key()) != want {
+			t.Fatalf("unexpected key: %q, want %q", sc.Key(), want)
+		}
+		if err = sc.Next(); err != nil {
+			t.Fatalf("Scanner.Next: %s", err.Error())
+		}
+	}
+	if i != 200 {
+		t.Fatalf("scanned up to %d", i)
+	}
+}
+
+func TestKVTransaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestKV(t, path)
+	if err := db.Set([]byte("a"), []byte("1")); err != nil {
+		t.Fatalf("KV.Set: %s", err.Error())
+	}
+
+	// aborted updates are discarded
+	tx := db.Begin()
+	if err := tx.Set([]byte("b"), []byte("2")); err != nil {
+		t.Fatalf("KVTX.Set: %s", err.Error())
+	}
+	if val, found, _ := tx.Get([]byte("b")); !found || string(val) != "2" {
+		t.Fatalf("KVTX.Get does not read its own writes")
+	}
+	if _, found, _ := db.Get([]byte("b")); found {
+		t.Fatalf("KV.Get reads uncommitted writes")
+	}
+	tx.Abort()
+	if _, found, _ := db.Get([]byte("b")); found {
+		t.Fatalf("KV.Get reads aborted writes")
+	}
+
+	// committed updates are applied at once
+	tx = db.Begin()
+	if _, err := tx.Del([]byte("a")); err != nil {
+		t.Fatalf("KVTX.Del: %s", err.Error())
+	}
+	for i := 0; i < 100; i++ {
+		if err := tx.Set([]byte(fmt.Sprintf("key_%02d", i)), []byte("val")); err != nil {
+			t.Fatalf("KVTX.Set: %s", err.Error())
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("KVTX.Commit: %s", err.Error())
+	}
+	if err := tx.Commit(); err != ErrTxDone {
+		t.Fatalf("KVTX.Commit twice: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("KV.Close: %s", err.Error())
+	}
+
+	db = openTestKV(t, path)
+	defer db.Close()
+	if _, found, _ := db.Get([]byte("a")); found {
+		t.Fatalf("KV.Get found a deleted key")
+	}
+	sc, err := db.Scan(nil, nil)
+	if err != nil {
+		t.Fatalf("KV.Scan: %s", err.Error())
+	}
+	defer sc.Close()
+	n := 0
+	for ; sc.Valid(); n++ {
+		if err = sc.Next(); err != nil {
+			t.Fatalf("Scanner.Next: %s", err.Error())
+		}
+	}
+	if n != 100 {
+		t.Fatalf("unexpected number of keys: %d", n)
+	}
+}
+
+func TestKVConcurrentReaders(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestKV(t, path)
+	defer db.Close()
+
+	// the writer updates all keys to the same value in each transaction
+	write := func(i int) {
+		tx := db.Begin()
+		for k := 0; k < 50; k++ {
+			if err := tx.Set([]byte(fmt.Sprintf("key_%02d", k)), []byte(fmt.Sprintf("val_%04d", i))); err != nil {
+				t.Errorf("KVTX.Set: %s", err.Error())
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			t.Errorf("KVTX.Commit: %s", err.Error())
+		}
+	}
+	write(0)
+
+	done := make(chan struct{})
+	errs := make(chan error, 4)
+	for n := 0; n < 4; n++ {
+		go func() {
+			for {
+				select {
+				case <-done:
+					errs <- nil
+					return
+				default:
+				}
+				// every key in a snapshot has the same value
+				r := db.BeginRead()
+				first, _, err := r.Get([]byte("key_00"))
+				for k := 1; k < 50 && err == nil; k++ {
+					var val []byte
+					if val, _, err = r.Get([]byte(fmt.Sprintf("key_%02d", k))); err == nil && string(val) != string(first) {
+						err = fmt.Errorf("inconsistent snapshot: %q != %q", val, first)
+					}
+				}
+				r.End()
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	for i := 1; i < 200; i++ {
+		write(i)
+	}
+	close(done)
+	for n := 0; n < 4; n++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestKVCorruption(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestKV(t, path)
+	if err := db.Set([]byte("key"), []byte("val")); err != nil {
+		t.Fatalf("KV.Set: %s", err.Error())
+	}
+	root := db.tree.Root
+	if err := db.Close(); err != nil {
+		t.Fatalf("KV.Close: %s", err.Error())
+	}
+
+	// damage the unused space of the root page
+	f, err := os.OpenFile(path, os.O_RDWR, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.WriteAt([]byte{0xff}, int64(root*btree.BTREE_PAGE_SIZE+100)); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	db = openTestKV(t, path)
+	_, _, err = db.Get([]byte("key"))
+	var cerr *CorruptionError
+	if !errors.As(err, &cerr) || cerr.Page != root {
+		t.Fatalf("KV.Get: unexpected error: %v", err)
+	}
+	db.Close()
+
+	// the damage is not noticed without verification
+	db = &KV{Path: path, NoVerify: true}
+	if err = db.Open(); err != nil {
+		t.Fatalf("KV.Open: %s", err.Error())
+	}
+	defer db.Close()
+	if val, found, err := db.Get([]byte("key")); err != nil || !found || string(val) != "val" {
+		t.Fatalf("KV.Get = %q, %v, %v", val, found, err)
+	}
+}
+
+func TestKVTornMetaPage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestKV(t, path)
+	if err := db.Set([]byte("key"), []byte("old")); err != nil {
+		t.Fatalf("KV.Set: %s", err.Error())
+	}
+	if err := db.Set([]byte("key"), []byte("new")); err != nil {
+		t.Fatalf("KV.Set: %s", err.Error())
+	}
+	slot := db.metaSlot
+	if err := db.Close(); err != nil {
+		t.Fatalf("KV.Close: %s", err.Error())
+	}
+
+	// damage the slot of the last commit
+	f, err := os.OpenFile(path, os.O_RDWR, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.WriteAt([]byte{0xff}, int64(slot*META_SLOT_OFFSET+20)); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	// the previous commit is used
+	db = openTestKV(t, path)
+	defer db.Close()
+	if val, found, err := db.Get([]byte("key")); err != nil || !found || string(val) != "old" {
+		t.Fatalf("KV.Get = %q, %v, %v", val, found, err)
+	}
+	if err := db.Set([]byte("key"), []byte("newer")); err != nil {
+		t.Fatalf("KV.Set: %s", err.Error())
+	}
+}
+
+func TestKVCheck(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestKV(t, path)
+	for i := 0; i < 3000; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("key_%d", i)), []byte(fmt.Sprintf("val_%0100d", i))); err != nil {
+			t.Fatalf("KV.Set: %s", err.Error())
+		}
+	}
+	for i := 0; i < 3000; i += 3 {
+		if _, err := db.Del([]byte(fmt.Sprintf("key_%d", i))); err != nil {
+			t.Fatalf("KV.Del: %s", err.Error())
+		}
+	}
+	root := db.tree.Root
+	if err := db.Close(); err != nil {
+		t.Fatalf("KV.Close: %s", err.Error())
+	}
+
+	res, err := Check(path)
+	if err != nil {
+		t.Fatalf("Check: %s", err.Error())
+	}
+	if !res.OK() {
+		t.Fatalf("Check: %v, leaked %v", res.Violations, res.Leaked)
+	}
+	if res.Tree.Keys != 2000 {
+		t.Fatalf("Check: unexpected number of keys: %d", res.Tree.Keys)
+	}
+
+	// damage the root page
+	f, err := os.OpenFile(path, os.O_RDWR, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.WriteAt([]byte{0xff}, int64(root*btree.BTREE_PAGE_SIZE+2)); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if res, err = Check(path); err != nil {
+		t.Fatalf("Check: %s", err.Error())
+	}
+	if res.OK() {
+		t.Fatalf("Check did not notice a damaged page")
+	}
+}
+
+func TestKVInspect(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestKV(t, path)
+	if err := db.Set([]byte("key"), []byte("val")); err != nil {
+		t.Fatalf("KV.Set: %s", err.Error())
+	}
+	root, version := db.tree.Root, db.version
+	if err := db.Close(); err != nil {
+		t.Fatalf("KV.Close: %s", err.Error())
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	slots, err := ReadMetaSlots(f)
+	if err != nil {
+		t.Fatalf("ReadMetaSlots: %s", err.Error())
+	}
+	meta := NewestMetaSlot(slots)
+	if meta == nil || meta.Root != root || meta.Version != version {
+		t.Fatalf("NewestMetaSlot = %+v", meta)
+	}
+
+	page, stored, computed, err := ReadPage(f, root, meta.PageSize)
+	if err != nil {
+		t.Fatalf("ReadPage: %s", err.Error())
+	}
+	if stored != computed {
+		t.Fatalf("ReadPage: checksum mismatch")
+	}
+	dump, err := btree.DumpNode(page)
+	if err != nil {
+		t.Fatalf("DumpNode: %s", err.Error())
+	}
+	if dump.Type != btree.BNODE_LEAF || dump.NKeys != 2 || string(dump.Vals[1]) != "val" {
+		t.Fatalf("DumpNode = %+v", dump)
+	}
+}
+
+func TestKVLargeValues(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestKV(t, path)
+	large := func(i int) []byte {
+		return []byte(fmt.Sprintf("%0*d", 20000+i*1000, i))
+	}
+	for i := 0; i < 20; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("key_%02d", i)), large(i)); err != nil {
+			t.Fatalf("KV.Set: %s", err.Error())
+		}
+	}
+	pages := db.Stats().Pages
+	// overwriting the values reuses the freed overflow pages
+	for i := 0; i < 20; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("key_%02d", i)), large(i)); err != nil {
+			t.Fatalf("KV.Set: %s", err.Error())
+		}
+	}
+	if got := db.Stats().Pages; got > pages+20 {
+		t.Fatalf("the file grew from %d to %d pages", pages, got)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("KV.Close: %s", err.Error())
+	}
+
+	db = openTestKV(t, path)
+	sc, err := db.Scan(nil, nil)
+	if err != nil {
+		t.Fatalf("KV.Scan: %s", err.Error())
+	}
+	n := 0
+	for ; sc.Valid(); n++ {
+		val, err := sc.Val()
+		if err != nil || !bytes.Equal(val, large(n)) {
+			t.Fatalf("Scanner.Val = %d bytes, %v", len(val), err)
+		}
+		if err = sc.Next(); err != nil {
+			t.Fatalf("Scanner.Next: %s", err.Error())
+		}
+	}
+	sc.Close()
+	if n != 20 {
+		t.Fatalf("scanned %d keys", n)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("KV.Close: %s", err.Error())
+	}
+
+	res, err := Check(path)
+	if err != nil {
+		t.Fatalf("Check: %s", err.Error())
+	}
+	if !res.OK() || res.Tree.Overflow == 0 {
+		t.Fatalf("Check: %v, leaked %v, %d overflow pages", res.Violations, res.Leaked, res.Tree.Overflow)
+	}
+}
+
+func TestKVPageSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := &KV{Path: path, PageSize: 16384}
+	if err := db.Open(); err != nil {
+		t.Fatalf("KV.Open: %s", err.Error())
+	}
+	for i := 0; i < 2000; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("key_%d", i)), []byte(fmt.Sprintf("val_%0100d", i))); err != nil {
+			t.Fatalf("KV.Set: %s", err.Error())
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("KV.Close: %s", err.Error())
+	}
+
+	// the page size is read from the meta page
+	db = openTestKV(t, path)
+	if size := db.Stats().PageSize; size != 16384 {
+		t.Fatalf("unexpected page size: %d", size)
+	}
+	if val, found, err := db.Get([]byte("key_1999")); err != nil || !found || string(val) != fmt.Sprintf("val_%0100d", 1999) {
+		t.Fatalf("KV.Get = %q, %v, %v", val, found, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("KV.Close: %s", err.Error())
+	}
+
+	db = &KV{Path: path, PageSize: 4096}
+	if err := db.Open(); err == nil {
+		db.Close()
+		t.Fatalf("KV.Open with a different page size succeeded")
+	}
+	for _, size := range []int{5000, 65536} {
+		db = &KV{Path: filepath.Join(t.TempDir(), "bad.db"), PageSize: size}
+		err := db.Open()
+		if err == nil {
+			db.Close()
+		}
+		if err == nil || !strings.Contains(err.Error(), "16-bit offsets") {
+			t.Fatalf("KV.Open with page size %d: %v", size, err)
+		}
+	}
+
+	res, err := Check(path)
+	if err != nil {
+		t.Fatalf("Check: %s", err.Error())
+	}
+	if !res.OK() || res.Tree.Keys != 2000 {
+		t.Fatalf("Check: %v, leaked %v, %d keys", res.Violations, res.Leaked, res.Tree.Keys)
+	}
+}
+
+func TestKVComparator(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	numeric := btree.Comparator{Name: "numeric", Compare: func(a, b []byte) int {
+		if len(a) != len(b) {
+			return len(a) - len(b) // no leading zeros
+		}
+		return bytes.Compare(a, b)
+	}}
+	db := &KV{Path: path, Comparator: numeric}
+	if err := db.Open(); err != nil {
+		t.Fatalf("KV.Open: %s", err.Error())
+	}
+	for _, key := range []string{"100", "9", "20"} {
+		if err := db.Set([]byte(key), []byte(key)); err != nil {
+			t.Fatalf("KV.Set: %s", err.Error())
+		}
+	}
+	sc, err := db.Scan([]byte("10"), []byte("100"))
+	if err != nil {
+		t.Fatalf("KV.Scan: %s", err.Error())
+	}
+	if !sc.Valid() || string(sc.Key()) != "20" {
+		t.Fatalf("unexpected key: %q", sc.Key())
+	}
+	if err = sc.Next(); err != nil || sc.Valid() {
+		t.Fatalf("the scanner is valid past the end: %v", err)
+	}
+	sc.Close()
+	if err := db.Close(); err != nil {
+		t.Fatalf("KV.Close: %s", err.Error())
+	}
+
+	// the order is recorded in the meta page
+	for _, cmp := range []btree.Comparator{{}, btree.Bytewise} {
+		db = &KV{Path: path, Comparator: cmp}
+		if err := db.Open(); err == nil {
+			db.Close()
+			t.Fatalf("KV.Open with the comparator %q succeeded", cmp.Name)
+		}
+	}
+	db = &KV{Path: path, Comparator: numeric}
+	if err := db.Open(); err != nil {
+		t.Fatalf("KV.Open: %s", err.Error())
+	}
+	db.Close()
+
+	// the key order is verified with the same comparator
+	if _, err := Check(path); err == nil {
+		t.Fatalf("Check without the comparator succeeded")
+	}
+	res, err := CheckWith(path, numeric)
+	if err != nil {
+		t.Fatalf("CheckWith: %s", err.Error())
+	}
+	if !res.OK() || res.Tree.Keys != 3 {
+		t.Fatalf("CheckWith: %v, %d keys", res.Violations, res.Tree.Keys)
+	}
+	if res, err = CheckWith(path, btree.Comparator{Name: "numeric", Compare: bytes.Compare}); err != nil {
+		t.Fatalf("CheckWith: %s", err.Error())
+	}
+	if res.OK() {
+		t.Fatalf("CheckWith did not notice the wrong key order")
+	}
+}
+
+func TestKVBulkLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestKV(t, path)
+	for i := 0; i < 100; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("old_%d", i)), []byte("x")); err != nil {
+			t.Fatalf("KV.Set: %s", err.Error())
+		}
+	}
+
+	bl, err := db.BulkLoad(btree.BTREE_BULK_FILL)
+	if err != nil {
+		t.Fatalf("KV.BulkLoad: %s", err.Error())
+	}
+	for i := 0; i < 20000; i++ {
+		val := []byte(fmt.Sprintf("val_%d", i))
+		if i%1000 == 0 {
+			val = bytes.Repeat(val, 1000) // overflow pages
+		}
+		if err := bl.Add([]byte(fmt.Sprintf("key_%06d", i)), val); err != nil {
+			t.Fatalf("BulkLoader.Add: %s", err.Error())
+		}
+	}
+	if err := bl.Add([]byte("key_000001"), nil); err == nil {
+		t.Fatalf("BulkLoader.Add accepted a key out of order")
+	}
+	if err := bl.Commit(); err != nil {
+		t.Fatalf("BulkLoader.Commit: %s", err.Error())
+	}
+
+	if _, found, _ := db.Get([]byte("old_1")); found {
+		t.Fatalf("the old content is not replaced")
+	}
+	for _, i := range []int{0, 1, 12345, 19999} {
+		want := fmt.Sprintf("val_%d", i)
+		if i%1000 == 0 {
+			want = strings.Repeat(want, 1000)
+		}
+		if val, found, err := db.Get([]byte(fmt.Sprintf("key_%06d", i))); err != nil || !found || string(val) != want {
+			t.Fatalf("KV.Get(%d) = %d bytes, %v, %v", i, len(val), found, err)
+		}
+	}
+	if err := db.Set([]byte("key_000000_"), []byte("new")); err != nil {
+		t.Fatalf("KV.Set: %s", err.Error())
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("KV.Close: %s", err.Error())
+	}
+
+	res, err := Check(path)
+	if err != nil {
+		t.Fatalf("Check: %s", err.Error())
+	}
+	if !res.OK() || res.Tree.Keys != 20001 {
+		t.Fatalf("Check: %v, leaked %v, %d keys", res.Violations, res.Leaked, res.Tree.Keys)
+	}
+}
+
+func TestKVWriteBatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestKV(t, path)
+	defer db.Close()
+
+	var b Batch
+	for i := 0; i < 5000; i++ {
+		b.Set([]byte(fmt.Sprintf("key_%d", i)), []byte(fmt.Sprintf("val_%d", i)))
+	}
+	b.Del([]byte("key_1"))
+	b.Set([]byte("key_2"), []byte("new"))
+	b.Del([]byte("missing"))
+	version := db.Stats().Version
+	if err := db.Write(&b); err != nil {
+		t.Fatalf("KV.Write: %s", err.Error())
+	}
+	if got := db.Stats().Version; got != version+1 {
+		t.Fatalf("the batch took %d commits", got-version)
+	}
+
+	for key, want := range map[string]string{"key_0": "val_0", "key_1": "", "key_2": "new", "key_4999": "val_4999"} {
+		val, found, err := db.Get([]byte(key))
+		if err != nil || found != (want != "") || string(val) != want {
+			t.Fatalf("KV.Get(%q) = %q, %v, %v", key, val, found, err)
+		}
+	}
+
+	// fewer pages than single updates
+	b.Reset()
+	for i := 0; i < 100; i++ {
+		b.Set([]byte(fmt.Sprintf("key_%d", 1000+i)), []byte("batch"))
+	}
+	pages := db.Stats().Pages
+	if err := db.Write(&b); err != nil {
+		t.Fatalf("KV.Write: %s", err.Error())
+	}
+	if grown := db.Stats().Pages - pages; grown > 10 {
+		t.Fatalf("the file grew by %d pages", grown)
+	}
+}
+
+func TestKVGroupCommit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := &KV{Path: path, GroupCommit: true, GroupDelay: time.Millisecond}
+	if err := db.Open(); err != nil {
+		t.Fatalf("KV.Open: %s", err.Error())
+	}
+
+	const writers, nkeys = 16, 200
+	version := db.Stats().Version
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < nkeys; i++ {
+				key := []byte(fmt.Sprintf("w%d_key_%d", w, i))
+				if err := db.Set(key, []byte(fmt.Sprintf("val_%d", i))); err != nil {
+					errs <- err
+					return
+				}
+				if i%2 == 0 {
+					continue
+				}
+				// each caller gets its own result
+				deleted, err := db.Del(key)
+				if err != nil || !deleted {
+					errs <- fmt.Errorf("KV.Del(%q) = %v, %v", key, deleted, err)
+					return
+				}
+				if deleted, err = db.Del(key); err != nil || deleted {
+					errs <- fmt.Errorf("KV.Del(%q) again = %v, %v", key, deleted, err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	// invalid updates fail alone
+	if err := db.Set(nil, []byte("x")); err == nil {
+		t.Fatal("KV.Set with an empty key succeeded")
+	}
+	if deleted, err := db.Del(nil); err != nil || deleted {
+		t.Fatalf("KV.Del(nil) = %v, %v", deleted, err)
+	}
+
+	ops := writers * nkeys * 2
+	if commits := db.Stats().Version - version; commits >= uint64(ops) {
+		t.Fatalf("%d commits for %d updates", commits, ops)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("KV.Close: %s", err.Error())
+	}
+	if err := db.Set([]byte("k"), []byte("v")); !errors.Is(err, ErrClosed) {
+		t.Fatalf("KV.Set after Close: %v", err)
+	}
+
+	db = openTestKV(t, path)
+	for w := 0; w < writers; w++ {
+		for i := 0; i < nkeys; i++ {
+			key := fmt.Sprintf("w%d_key_%d", w, i)
+			val, found, err := db.Get([]byte(key))
+			if err != nil || found != (i%2 == 0) || (found && string(val) != fmt.Sprintf("val_%d", i)) {
+				t.Fatalf("KV.Get(%q) = %q, %v, %v", key, val, found, err)
+			}
+		}
+	}
+	db.Close()
+	res, err := Check(path)
+	if err != nil {
+		t.Fatalf("Check: %s", err.Error())
+	}
+	if !res.OK() {
+		t.Fatalf("Check: %v, leaked %v", res.Violations, res.Leaked)
+	}
+}
+
+func TestKVSyncModes(t *testing.T) {
+	for _, mode := range []SyncMode{SyncFull, SyncData, SyncPeriodic, SyncNone} {
+		path := filepath.Join(t.TempDir(), "test.db")
+		db := &KV{Path: path, Sync: mode}
+		if err := db.Open(); err != nil {
+			t.Fatalf("%s: KV.Open: %s", mode, err.Error())
+		}
+		for i := 0; i < 1000; i++ {
+			if err := db.Set([]byte(fmt.Sprintf("key_%d", i)), []byte("val")); err != nil {
+				t.Fatalf("%s: KV.Set: %s", mode, err.Error())
+			}
+		}
+		if err := db.Close(); err != nil {
+			t.Fatalf("%s: KV.Close: %s", mode, err.Error())
+		}
+
+		res, err := Check(path)
+		if err != nil {
+			t.Fatalf("%s: Check: %s", mode, err.Error())
+		}
+		if !res.OK() || res.Tree.Keys != 1000 {
+			t.Fatalf("%s: Check: %v, leaked %v, %d keys", mode, res.Violations, res.Leaked, res.Tree.Keys)
+		}
+	}
+
+	db := &KV{Path: filepath.Join(t.TempDir(), "test.db"), Sync: SyncMode(100)}
+	if err := db.Open(); err == nil {
+		db.Close()
+		t.Fatal("KV.Open with a bad sync mode succeeded")
+	}
+}
+
+// the on-disk version of the database
+func diskVersion(t *testing.T, path string) uint64 {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	slots, err := ReadMetaSlots(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newest := NewestMetaSlot(slots)
+	if newest == nil {
+		t.Fatal("no valid meta slot")
+	}
+	return newest.Version
+}
+
+func TestKVSyncPeriodic(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := &KV{Path: path, Sync: SyncPeriodic, SyncInterval: time.Hour}
+	if err := db.Open(); err != nil {
+		t.Fatalf("KV.Open: %s", err.Error())
+	}
+	defer db.Close()
+	tx := db.Begin()
+	if err := tx.SetSync(SyncFull); err != nil {
+		t.Fatalf("KVTX.SetSync: %s", err.Error())
+	}
+	if err := tx.Set([]byte("k1"), []byte("v1")); err != nil {
+		t.Fatalf("KVTX.Set: %s", err.Error())
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("KVTX.Commit: %s", err.Error())
+	}
+	if got := diskVersion(t, path); got != 1 {
+		t.Fatalf("on-disk version %d after a synced commit", got)
+	}
+
+	// visible, but not in the meta page until the next sync
+	for i := 0; i < 100; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("key_%d", i)), []byte("val")); err != nil {
+			t.Fatalf("KV.Set: %s", err.Error())
+		}
+	}
+	if val, found, err := db.Get([]byte("key_99")); err != nil || !found || string(val) != "val" {
+		t.Fatalf("KV.Get = %q, %v, %v", val, found, err)
+	}
+	if got := diskVersion(t, path); got != 1 {
+		t.Fatalf("on-disk version %d before the sync", got)
+	}
+	// freed pages are not reused before the sync
+	pages := db.Stats().Pages
+	if err := db.Set([]byte("key_0"), []byte("new")); err != nil {
+		t.Fatalf("KV.Set: %s", err.Error())
+	}
+	if db.Stats().Pages == pages {
+		t.Fatal("freed pages were reused before the sync")
+	}
+
+	db.writer.Lock()
+	err := syncMeta(db)
+	db.writer.Unlock()
+	if err != nil {
+		t.Fatalf("syncMeta: %s", err.Error())
+	}
+	if got, want := diskVersion(t, path), db.Stats().Version; got != want {
+		t.Fatalf("on-disk version %d, want %d", got, want)
+	}
+}
+
+// a rollback doesn't make the pages freed since the sync reusable
+func TestKVSyncPeriodicAbort(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := &KV{Path: path, Sync: SyncPeriodic, SyncInterval: time.Hour}
+	if err := db.Open(); err != nil {
+		t.Fatalf("KV.Open: %s", err.Error())
+	}
+	defer db.Close()
+	set := func(n int) {
+		for i := 0; i < n; i++ {
+			if err := db.Set([]byte(fmt.Sprintf("key_%d", i)), []byte(strings.Repeat("v", 200))); err != nil {
+				t.Fatalf("KV.Set: %s", err.Error())
+			}
+		}
+	}
+	set(50)
+	db.writer.Lock()
+	err := syncMeta(db)
+	db.writer.Unlock()
+	if err != nil {
+		t.Fatalf("syncMeta: %s", err.Error())
+	}
+	set(50) // frees the pages of the on-disk meta page
+
+	db.Begin().Abort()
+	if deleted, err := db.Del([]byte("missing")); err != nil || deleted {
+		t.Fatalf("KV.Del = %v, %v", deleted, err)
+	}
+	set(50)
+
+	// the on-disk meta page is still the synced one
+	dst := t.TempDir()
+	copyFiles(t, dst, path)
+	res, err := Check(filepath.Join(dst, "test.db"))
+	if err != nil {
+		t.Fatalf("Check: %s", err.Error())
+	}
+	if !res.OK() {
+		t.Fatalf("Check: %v", res)
+	}
+}
+
+// copy the files of an open database, as they would be after a crash
+func copyFiles(t *testing.T, dst string, src ...string) {
+	t.Helper()
+	for _, name := range src {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = os.WriteFile(filepath.Join(dst, filepath.Base(name)), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestKVWAL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := &KV{Path: path, WAL: true, CheckpointSize: 1 << 30}
+	if err := db.Open(); err != nil {
+		t.Fatalf("KV.Open: %s", err.Error())
+	}
+	defer db.Close()
+	version := diskVersion(t, path)
+	for i := 0; i < 500; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("key_%d", i)), []byte(fmt.Sprintf("val_%d", i))); err != nil {
+			t.Fatalf("KV.Set: %s", err.Error())
+		}
+	}
+	if deleted, err := db.Del([]byte("key_1")); err != nil || !deleted {
+		t.Fatalf("KV.Del = %v, %v", deleted, err)
+	}
+	var b Batch
+	b.Set([]byte("key_2"), []byte("batch"))
+	b.Del([]byte("key_3"))
+	if err := db.Write(&b); err != nil {
+		t.Fatalf("KV.Write: %s", err.Error())
+	}
+	// the commits are only in the log
+	if got := diskVersion(t, path); got != version {
+		t.Fatalf("on-disk version %d, want %d", got, version)
+	}
+
+	// crash and replay, a torn record at the tail is discarded
+	dir := t.TempDir()
+	copyFiles(t, dir, path, path+WAL_SUFFIX)
+	f, err := os.OpenFile(filepath.Join(dir, "test.db"+WAL_SUFFIX), os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{40, 0, 0, 0, 1, 2, 3})
+	f.Close()
+	crashed := &KV{Path: filepath.Join(dir, "test.db"), WAL: true}
+	if err := crashed.Open(); err != nil {
+		t.Fatalf("KV.Open: %s", err.Error())
+	}
+	for key, want := range map[string]string{"key_0": "val_0", "key_1": "", "key_2": "batch", "key_3": "", "key_499": "val_499"} {
+		val, found, err := crashed.Get([]byte(key))
+		if err != nil || found != (want != "") || string(val) != want {
+			t.Fatalf("KV.Get(%q) = %q, %v, %v", key, val, found, err)
+		}
+	}
+	if got, want := crashed.Stats().Version, db.Stats().Version; got != want {
+		t.Fatalf("replayed version %d, want %d", got, want)
+	}
+	if err := crashed.Close(); err != nil {
+		t.Fatalf("KV.Close: %s", err.Error())
+	}
+	res, err := Check(crashed.Path)
+	if err != nil || !res.OK() || res.Tree.Keys != 498 {
+		t.Fatalf("Check: %v, %v, leaked %v, %d keys", err, res.Violations, res.Leaked, res.Tree.Keys)
+	}
+
+	// replayed without WAL too, the log is removed then
+	dir = t.TempDir()
+	copyFiles(t, dir, path, path+WAL_SUFFIX)
+	plain := openTestKV(t, filepath.Join(dir, "test.db"))
+	if val, found, err := plain.Get([]byte("key_2")); err != nil || !found || string(val) != "batch" {
+		t.Fatalf("KV.Get = %q, %v, %v", val, found, err)
+	}
+	if got, want := plain.Stats().Version, db.Stats().Version; got != want {
+		t.Fatalf("replayed version %d, want %d", got, want)
+	}
+	plain.Close()
+	if _, err := os.Stat(plain.Path + WAL_SUFFIX); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("the log is not removed: %v", err)
+	}
+
+	// a log is not replayed on top of other commits
+	dir = t.TempDir()
+	copyFiles(t, dir, path)
+	plain = openTestKV(t, filepath.Join(dir, "test.db"))
+	for i := 0; i < 3; i++ {
+		if err := plain.Set([]byte("other"), []byte("val")); err != nil {
+			t.Fatalf("KV.Set: %s", err.Error())
+		}
+	}
+	plain.Close()
+	copyFiles(t, dir, path+WAL_SUFFIX)
+	if err := (&KV{Path: plain.Path}).Open(); err == nil || !strings.Contains(err.Error(), "continues the version") {
+		t.Fatalf("KV.Open with a log of another history: %v", err)
+	}
+	if err := (&KV{Path: plain.Path}).OpenReadOnly(); err == nil {
+		t.Fatal("KV.OpenReadOnly with a log of another history succeeded")
+	}
+
+	// checkpoint when the log is full
+	db.CheckpointSize = 4096
+	for i := 0; i < 200; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("key_%d", i)), []byte("new")); err != nil {
+			t.Fatalf("KV.Set: %s", err.Error())
+		}
+	}
+	if got := diskVersion(t, path); got == version {
+		t.Fatal("no checkpoint")
+	}
+	if fi, err := os.Stat(path + WAL_SUFFIX); err != nil || fi.Size() > 4096 {
+		t.Fatalf("the log is not emptied: %v, %v", fi.Size(), err)
+	}
+	if err := db.Checkpoint(); err != nil {
+		t.Fatalf("KV.Checkpoint: %s", err.Error())
+	}
+	if got, want := diskVersion(t, path), db.Stats().Version; got != want {
+		t.Fatalf("on-disk version %d, want %d", got, want)
+	}
+}
+
+// the bytes passed to write calls by the process, see proc(5)
+func writtenBytes(t *testing.T) int64 {
+	t.Helper()
+	data, err := os.ReadFile("/proc/self/io")
+	if err != nil {
+		t.Skipf("no I/O statistics: %s", err.Error())
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		var n int64
+		if _, err := fmt.Sscanf(line, "wchar: %d", &n); err == nil {
+			return n
+		}
+	}
+	t.Fatalf("no wchar in /proc/self/io")
+	return 0
+}
+
+func TestKVWALWrites(t *testing.T) {
+	written := map[bool]int64{}
+	for _, wal := range []bool{false, true} {
+		path := filepath.Join(t.TempDir(), "test.db")
+		db := &KV{Path: path, WAL: wal, CheckpointSize: 1 << 30}
+		if err := db.Open(); err != nil {
+			t.Fatalf("KV.Open: %s", err.Error())
+		}
+		var b Batch
+		for i := 0; i < 1000; i++ {
+			b.Set([]byte(fmt.Sprintf("key_%d", i)), []byte(fmt.Sprintf("val_%d", i)))
+		}
+		if err := db.Write(&b); err != nil {
+			t.Fatalf("KV.Write: %s", err.Error())
+		}
+
+		// small commits, the log mode writes the pages once at the checkpoint
+		before := writtenBytes(t)
+		for i := 0; i < 100; i++ {
+			if err := db.Set([]byte(fmt.Sprintf("key_%d", i)), []byte("new")); err != nil {
+				t.Fatalf("KV.Set: %s", err.Error())
+			}
+		}
+		if err := db.Checkpoint(); err != nil {
+			t.Fatalf("KV.Checkpoint: %s", err.Error())
+		}
+		written[wal] = writtenBytes(t) - before
+
+		// a reader keeps its version across a checkpoint
+		r := db.BeginRead()
+		for i := 0; i < 10; i++ {
+			if err := db.Set([]byte("key_0"), []byte(fmt.Sprintf("newer_%d", i))); err != nil {
+				t.Fatalf("KV.Set: %s", err.Error())
+			}
+		}
+		if err := db.Checkpoint(); err != nil {
+			t.Fatalf("KV.Checkpoint: %s", err.Error())
+		}
+		if val, found, err := r.Get([]byte("key_0")); err != nil || !found || string(val) != "new" {
+			t.Fatalf("KVReader.Get = %q, %v, %v", val, found, err)
+		}
+		r.End()
+		if val, found, err := db.Get([]byte("key_0")); err != nil || !found || string(val) != "newer_9" {
+			t.Fatalf("KV.Get = %q, %v, %v", val, found, err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatalf("KV.Close: %s", err.Error())
+		}
+		res, err := Check(path)
+		if err != nil || !res.OK() || res.Tree.Keys != 1000 {
+			t.Fatalf("Check: %v, %v, leaked %v, %d keys", err, res.Violations, res.Leaked, res.Tree.Keys)
+		}
+	}
+	if written[true]*10 > written[false] {
+		t.Fatalf("%d bytes written with the log, %d without", written[true], written[false])
+	}
+}
+
+func TestKVLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestKV(t, path)
+
+	other := &KV{Path: path}
+	err := other.Open()
+	if !errors.Is(err, ErrLocked) {
+		t.Fatalf("KV.Open of a locked database: %v", err)
+	}
+
+	// wait for the lock
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		db.Close()
+	}()
+	other.LockTimeout = 5 * time.Second
+	if err = other.Open(); err != nil {
+		t.Fatalf("KV.Open: %s", err.Error())
+	}
+	if err = other.Set([]byte("key"), []byte("val")); err != nil {
+		t.Fatalf("KV.Set: %s", err.Error())
+	}
+	other.Close()
+
+	// released on close
+	openTestKV(t, path).Close()
+}
+
+func TestKVReadOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestKV(t, path)
+	for i := 0; i < 100; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("key_%d", i)), []byte("val")); err != nil {
+			t.Fatalf("KV.Set: %s", err.Error())
+		}
+	}
+	db.Close()
+	before, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chmod(path, 0o444); err != nil {
+		t.Fatal(err)
+	}
+
+	db = &KV{Path: path}
+	if err = db.OpenReadOnly(); err != nil {
+		t.Fatalf("KV.OpenReadOnly: %s", err.Error())
+	}
+	if val, found, err := db.Get([]byte("key_7")); err != nil || !found || string(val) != "val" {
+		t.Fatalf("KV.Get = %q, %v, %v", val, found, err)
+	}
+	// shared with other readers, but not writers
+	other := &KV{Path: path}
+	if err = other.OpenReadOnly(); err != nil {
+		t.Fatalf("KV.OpenReadOnly: %s", err.Error())
+	}
+	other.Close()
+	if err = (&KV{Path: path}).Open(); !errors.Is(err, ErrLocked) {
+		t.Fatalf("KV.Open of a read-only opened database: %v", err)
+	}
+
+	// updates are rejected
+	if err = db.Set([]byte("key"), []byte("val")); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("KV.Set: %v", err)
+	}
+	if _, err = db.Del([]byte("key_7")); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("KV.Del: %v", err)
+	}
+	var b Batch
+	b.Set([]byte("key"), []byte("val"))
+	if err = db.Write(&b); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("KV.Write: %v", err)
+	}
+	if _, err = db.BulkLoad(1); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("KV.BulkLoad: %v", err)
+	}
+	tx := db.Begin()
+	if err = tx.Set([]byte("key"), []byte("val")); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("KVTX.Set: %v", err)
+	}
+	if err = tx.Commit(); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("KVTX.Commit: %v", err)
+	}
+	tx.Abort()
+	if err = db.Close(); err != nil {
+		t.Fatalf("KV.Close: %s", err.Error())
+	}
+	if after, _ := os.ReadFile(path); !bytes.Equal(before, after) {
+		t.Fatal("the file is modified")
+	}
+
+	// a missing file is not created
+	missing := filepath.Join(t.TempDir(), "missing.db")
+	if err = (&KV{Path: missing}).OpenReadOnly(); err == nil {
+		t.Fatal("KV.OpenReadOnly of a missing file succeeded")
+	}
+	if _, err = os.Stat(missing); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("the file is created: %v", err)
+	}
+}
+
+func TestKVBackup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := &KV{Path: path, PageSize: 8192, Comparator: btree.Reverse}
+	if err := db.Open(); err != nil {
+		t.Fatalf("KV.Open: %s", err.Error())
+	}
+	defer db.Close()
+	large := bytes.Repeat([]byte("x"), 20000)
+	for i := 0; i < 2000; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("key_%d", i)), []byte("val")); err != nil {
+			t.Fatalf("KV.Set: %s", err.Error())
+		}
+	}
+	if err := db.Set([]byte("large"), large); err != nil {
+		t.Fatalf("KV.Set: %s", err.Error())
+	}
+
+	// every commit of the writer updates all the keys to the same generation
+	writeGen := func(gen int) error {
+		var b Batch
+		for i := 0; i < 100; i++ {
+			b.Set([]byte(fmt.Sprintf("gen_%d", i)), []byte(fmt.Sprint(gen)))
+		}
+		return db.Write(&b)
+	}
+	if err := writeGen(0); err != nil {
+		t.Fatalf("KV.Write: %s", err.Error())
+	}
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		for gen := 1; ; gen++ {
+			select {
+			case <-stop:
+				done <- nil
+				return
+			default:
+			}
+			if err := writeGen(gen); err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+	var buf bytes.Buffer
+	time.Sleep(10 * time.Millisecond)
+	err := db.Backup(&buf)
+	close(stop)
+	if werr := <-done; werr != nil {
+		t.Fatalf("KV.Write: %s", werr.Error())
+	}
+	if err != nil {
+		t.Fatalf("KV.Backup: %s", err.Error())
+	}
+
+	dst := filepath.Join(t.TempDir(), "backup.db")
+	if err = os.WriteFile(dst, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	res, err := Check(dst)
+	if err != nil {
+		t.Fatalf("Check: %s", err.Error())
+	}
+	if !res.OK() || res.FreePages != 0 {
+		t.Fatalf("Check: %v, leaked %v, %d free pages", res.Violations, res.Leaked, res.FreePages)
+	}
+	if src := db.Stats().Pages; res.Pages >= src {
+		t.Fatalf("the backup has %d pages, the database %d", res.Pages, src)
+	}
+
+	backup := &KV{Path: dst, Comparator: btree.Reverse}
+	if err = backup.Open(); err != nil {
+		t.Fatalf("KV.Open: %s", err.Error())
+	}
+	defer backup.Close()
+	if val, found, err := backup.Get([]byte("large")); err != nil || !found || !bytes.Equal(val, large) {
+		t.Fatalf("KV.Get(large) = %d bytes, %v, %v", len(val), found, err)
+	}
+	gen, found, err := backup.Get([]byte("gen_0"))
+	if err != nil || !found {
+		t.Fatalf("KV.Get(gen_0) = %q, %v, %v", gen, found, err)
+	}
+	n := 0
+	sc, err := backup.Scan(nil, nil)
+	if err != nil {
+		t.Fatalf("KV.Scan: %s", err.Error())
+	}
+	for ; sc.Valid(); n++ {
+		if key := string(sc.Key()); strings.HasPrefix(key, "gen_") {
+			if val, _ := sc.Val(); !bytes.Equal(val, gen) {
+				t.Fatalf("%s = %q, gen_0 = %q", key, val, gen)
+			}
+		}
+		if err = sc.Next(); err != nil {
+			t.Fatalf("Scanner.Next: %s", err.Error())
+		}
+	}
+	sc.Close()
+	if n != 2101 {
+		t.Fatalf("%d keys in the backup, want 2101", n)
+	}
+	// and writable
+	if err = backup.Set([]byte("new"), []byte("val")); err != nil {
+		t.Fatalf("KV.Set: %s", err.Error())
+	}
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+func TestKVBackupFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestKV(t, path)
+	defer db.Close()
+	writeGen := func(gen int) error {
+		var b Batch
+		for i := 0; i < 100; i++ {
+			b.Set([]byte(fmt.Sprintf("gen_%d", i)), []byte(fmt.Sprintf("%d_%0200d", gen, gen)))
+		}
+		return db.Write(&b)
+	}
+	if err := writeGen(0); err != nil {
+		t.Fatalf("KV.Write: %s", err.Error())
+	}
+
+	// the commits during the backup reuse the pages of the snapshot
+	var buf bytes.Buffer
+	gen := 1
+	err := BackupFile(path, writerFunc(func(p []byte) (int, error) {
+		for ; gen < 5; gen++ {
+			if err := writeGen(gen); err != nil {
+				return 0, err
+			}
+		}
+		return buf.Write(p)
+	}))
+	if !errors.Is(err, ErrBackupChanged) {
+		t.Fatalf("BackupFile: %v", err)
+	}
+
+	// retried while the writer keeps committing
+	stop := make(chan struct{})
+	started := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		for gen := 5; ; gen++ {
+			select {
+			case <-stop:
+				done <- nil
+				return
+			default:
+			}
+			if err := writeGen(gen); err != nil {
+				done <- err
+				return
+			}
+			if gen == 5 {
+				close(started)
+			}
+		}
+	}()
+	<-started
+	backup := func() error {
+		buf.Reset()
+		for i := 0; i < 1000; i++ {
+			if err := BackupFile(path, &buf); !errors.Is(err, ErrBackupChanged) {
+				return err
+			}
+			buf.Reset()
+		}
+		return ErrBackupChanged
+	}
+	dir := t.TempDir()
+	for i := 0; i < 10; i++ {
+		if err = backup(); err != nil {
+			break
+		}
+		dst := filepath.Join(dir, fmt.Sprintf("backup_%d.db", i))
+		if err = os.WriteFile(dst, buf.Bytes(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		checkGenBackup(t, dst)
+	}
+	close(stop)
+	if werr := <-done; werr != nil {
+		t.Fatalf("KV.Write: %s", werr.Error())
+	}
+	if err != nil {
+		t.Fatalf("BackupFile: %s", err.Error())
+	}
+
+	if err = BackupFile(path+".missing", &buf); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("BackupFile of a missing file: %v", err)
+	}
+}
+
+// a backup of `TestKVBackupFile` is valid and has 1 generation of the keys
+func checkGenBackup(t *testing.T, path string) {
+	t.Helper()
+	if res, err := Check(path); err != nil || !res.OK() {
+		t.Fatalf("Check: %v, %v", res, err)
+	}
+	backup := openTestKV(t, path)
+	defer backup.Close()
+	want, found, err := backup.Get([]byte("gen_0"))
+	if err != nil || !found {
+		t.Fatalf("KV.Get(gen_0) = %q, %v, %v", want, found, err)
+	}
+	for i := 1; i < 100; i++ {
+		key := fmt.Sprintf("gen_%d", i)
+		if val, _, err := backup.Get([]byte(key)); err != nil || !bytes.Equal(val, want) {
+			t.Fatalf("KV.Get(%s) = %.10q, %v, gen_0 = %.10q", key, val, err, want)
+		}
+	}
+}
+
+// a database with most of its pages free
+func shrinkableKV(t *testing.T, path string) *KV {
+	t.Helper()
+	db := openTestKV(t, path)
+	var b Batch
+	for i := 0; i < 5000; i++ {
+		b.Set([]byte(fmt.Sprintf("key_%d", i)), bytes.Repeat([]byte("v"), 100))
+	}
+	if err := db.Write(&b); err != nil {
+		t.Fatalf("KV.Write: %s", err.Error())
+	}
+	for i := 0; i < 5000; i++ {
+		if i%100 == 0 {
+			continue
+		}
+		if _, err := db.Del([]byte(fmt.Sprintf("key_%d", i))); err != nil {
+			t.Fatalf("KV.Del: %s", err.Error())
+		}
+	}
+	return db
+}
+
+func checkShrunk(t *testing.T, stats CompactStats, path string) {
+	t.Helper()
+	if stats.PagesAfter >= stats.PagesBefore || stats.SizeAfter >= stats.SizeBefore {
+		t.Fatalf("not shrunk: %+v", stats)
+	}
+	finfo, err := os.Stat(path)
+	if err != nil || finfo.Size() != stats.SizeAfter {
+		t.Fatalf("file size %d, %v, stats %+v", finfo.Size(), err, stats)
+	}
+}
+
+func TestKVCompact(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.db")
+	db := shrinkableKV(t, path)
+	r := db.BeginRead()
+
+	dst := filepath.Join(dir, "test.db.compact")
+	stats, err := db.Compact(dst)
+	if err != nil {
+		t.Fatalf("KV.Compact: %s", err.Error())
+	}
+	checkShrunk(t, stats, path)
+	if _, err = os.Stat(dst); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("the new file is not renamed: %v", err)
+	}
+	// the old snapshot is still readable
+	if val, found, err := r.Get([]byte("key_100")); err != nil || !found || len(val) != 100 {
+		t.Fatalf("KVReader.Get = %q, %v, %v", val, found, err)
+	}
+	// the old mmaps are released by the last reader of the old file
+	retired := func() int {
+		db.reader.mu.Lock()
+		defer db.reader.mu.Unlock()
+		return len(db.mmap.retired)
+	}
+	if n := retired(); n != 1 {
+		t.Fatalf("%d retired mmaps, want 1", n)
+	}
+	r2 := db.BeginRead()
+	r.End()
+	if n := retired(); n != 0 {
+		t.Fatalf("%d retired mmaps after the old readers ended", n)
+	}
+	if _, err = db.Compact(dst); err != nil {
+		t.Fatalf("KV.Compact: %s", err.Error())
+	}
+	if n := retired(); n != 1 {
+		t.Fatalf("%d retired mmaps, want 1", n)
+	}
+	r2.End()
+	if _, err = db.Compact(dst); err != nil {
+		t.Fatalf("KV.Compact: %s", err.Error())
+	}
+	if n := retired(); n != 0 {
+		t.Fatalf("%d retired mmaps without readers", n)
+	}
+
+	// continue with the new file
+	if err = db.Set([]byte("new"), []byte("val")); err != nil {
+		t.Fatalf("KV.Set: %s", err.Error())
+	}
+	for _, key := range []string{"key_0", "key_4900", "new"} {
+		if _, found, err := db.Get([]byte(key)); err != nil || !found {
+			t.Fatalf("KV.Get(%q) = %v, %v", key, found, err)
+		}
+	}
+	if err = db.Close(); err != nil {
+		t.Fatalf("KV.Close: %s", err.Error())
+	}
+	res, err := Check(path)
+	if err != nil || !res.OK() || res.Tree.Keys != 51 {
+		t.Fatalf("Check: %v, %v, leaked %v, %d keys", err, res.Violations, res.Leaked, res.Tree.Keys)
+	}
+}
+
+func TestKVCompactInPlace(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := shrinkableKV(t, path)
+	stats, err := db.CompactInPlace()
+	if err != nil {
+		t.Fatalf("KV.CompactInPlace: %s", err.Error())
+	}
+	checkShrunk(t, stats, path)
+
+	for i := 0; i < 100; i++ {
+		if err = db.Set([]byte(fmt.Sprintf("new_%d", i)), []byte("val")); err != nil {
+			t.Fatalf("KV.Set: %s", err.Error())
+		}
+	}
+	if _, found, err := db.Get([]byte("key_4900")); err != nil || !found {
+		t.Fatalf("KV.Get = %v, %v", found, err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatalf("KV.Close: %s", err.Error())
+	}
+	res, err := Check(path)
+	if err != nil || !res.OK() || res.Tree.Keys != 150 {
+		t.Fatalf("Check: %v, %v, leaked %v, %d keys", err, res.Violations, res.Leaked, res.Tree.Keys)
+	}
+}
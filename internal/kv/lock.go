@@ -0,0 +1,38 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"time"
+)
+
+var ErrLocked = errors.New("database is locked")
+
+// the interval of retries while waiting for a lock
+const LOCK_RETRY = 10 * time.Millisecond
+
+// lock the database file against other processes: exclusive for writers,
+// shared for readers. it fails with `ErrLocked` after `timeout`, 0 means
+// no waiting. the lock is released when the file is closed.
+func lockFile(fd int, exclusive bool, timeout time.Duration) error {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		err := syscall.Flock(fd, how|syscall.LOCK_NB)
+		switch {
+		case err == nil:
+			return nil
+		case err == syscall.EINTR:
+			continue
+		case err != syscall.EWOULDBLOCK:
+			return fmt.Errorf("flock: %w", err)
+		case !time.Now().Before(deadline):
+			return ErrLocked
+		}
+		time.Sleep(LOCK_RETRY)
+	}
+}
@@ -1,28 +1,121 @@
 package kv
 
-import "encoding/binary"
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+
+	"github.com/vansilich/db/pkg/btree"
+	"github.com/vansilich/db/pkg/freelist"
+)
 
 // Structure of meta header :
-// | sig | root_ptr | page_used |
-// | 16B |    8B    |     8B    |
+// | sig | root_ptr | page_used | head_page | head_seq | tail_page | tail_seq | version | page_size | comparator | checksum |
+// | 16B |    8B    |     8B    |     8B    |    8B    |     8B    |    8B    |    8B   |     4B    |     32B    |    4B    |
+//
+// The comparator is the name of the key order (`btree.Comparator`), padded with zeros.
+//
+// The meta page has 2 slots for the header, at the start and at the middle of the smallest page.
+// Commits alternate between them by the version, the newest valid one is used on open.
+// The slot offsets don't depend on the page size, it's known only after the meta page is read.
 
-const DB_SIG = "BuildYourOwnDB06" // not compatible between chapters
-const META_SIZE_IN_BYTES = 32
+const DB_SIG = "BuildYourOwnDB11" // not compatible between chapters
+const META_SIZE_IN_BYTES = 116
+const META_COMPARATOR_SIZE = 32
+const META_SLOTS = 2
+const META_SLOT_OFFSET = btree.BTREE_MIN_PAGE_SIZE / META_SLOTS
 
 func saveMeta(db *KV) []byte {
-	var data [32]byte
+	var data [META_SIZE_IN_BYTES]byte
 	copy(data[:16], []byte(DB_SIG))
 	binary.LittleEndian.PutUint64(data[16:], db.tree.Root)
 	binary.LittleEndian.PutUint64(data[24:], db.page.flushed)
+	// the free list
+	fm := db.free.SaveMeta()
+	binary.LittleEndian.PutUint64(data[32:], fm.HeadPage)
+	binary.LittleEndian.PutUint64(data[40:], fm.HeadSeq)
+	binary.LittleEndian.PutUint64(data[48:], fm.TailPage)
+	binary.LittleEndian.PutUint64(data[56:], fm.TailSeq)
+	binary.LittleEndian.PutUint64(data[64:], db.version)
+	binary.LittleEndian.PutUint32(data[72:], uint32(db.page.size))
+	copy(data[76:76+META_COMPARATOR_SIZE], db.comparator)
+	binary.LittleEndian.PutUint32(data[112:], crc32.Checksum(data[:112], crcTable))
 	return data[:]
 }
 
-func loadMeta(db *KV, data []byte) {
+func checkMeta(data []byte) error {
+	if len(data) < META_SIZE_IN_BYTES {
+		return errors.New("bad meta page: too short")
+	}
 	sig := string(data[:16])
 	if sig != DB_SIG {
-		panic("loadMeta: bad sig")
+		return fmt.Errorf("bad meta page: signature %q", data[:16])
+	}
+	if crc32.Checksum(data[:112], crcTable) != binary.LittleEndian.Uint32(data[112:116]) {
+		return errors.New("bad meta page: checksum mismatch")
+	}
+	size := int(binary.LittleEndian.Uint32(data[72:76]))
+	if err := btree.CheckPageSize(size); err != nil {
+		return fmt.Errorf("bad meta page: %w", err)
+	}
+	return nil
+}
+
+// the newest valid slot of the meta page
+func newestMeta(page []byte) (newest []byte, slot uint64, err error) {
+	for i := uint64(0); i < META_SLOTS; i++ {
+		data := page[i*META_SLOT_OFFSET:][:META_SIZE_IN_BYTES]
+		if e := checkMeta(data); e != nil {
+			err = fmt.Errorf("meta slot %d: %w", i, e)
+			continue
+		}
+		if newest == nil || metaVersion(data) > metaVersion(newest) {
+			newest, slot = data, i
+		}
+	}
+	if newest == nil {
+		return nil, 0, err
 	}
+	return newest, slot, nil
+}
+
+func metaVersion(data []byte) uint64 {
+	return binary.LittleEndian.Uint64(data[64:72])
+}
+
+func loadMeta(db *KV, data []byte) error {
+	if err := checkMeta(data); err != nil {
+		return err
+	}
+	db.free.LoadMeta(metaFreeList(data))
+	loadMetaFields(db, data)
+	return nil
+}
+
+// roll back the in-memory state to the meta page of the last commit.
+// the pages freed since the last sync stay unavailable, the on-disk
+// meta page can still use them.
+func revertMeta(db *KV, data []byte) {
+	db.free.Revert(metaFreeList(data))
+	loadMetaFields(db, data)
+}
+
+func metaFreeList(data []byte) freelist.Meta {
+	return freelist.Meta{
+		HeadPage: binary.LittleEndian.Uint64(data[32:40]),
+		HeadSeq:  binary.LittleEndian.Uint64(data[40:48]),
+		TailPage: binary.LittleEndian.Uint64(data[48:56]),
+		TailSeq:  binary.LittleEndian.Uint64(data[56:64]),
+	}
+}
 
+// the fields other than the free list
+func loadMetaFields(db *KV, data []byte) {
 	db.tree.Root = binary.LittleEndian.Uint64(data[16:24])
 	db.page.flushed = binary.LittleEndian.Uint64(data[24:32])
+	db.version = binary.LittleEndian.Uint64(data[64:72])
+	db.page.size = int(binary.LittleEndian.Uint32(data[72:76]))
+	db.comparator = string(bytes.TrimRight(data[76:112], "\x00"))
 }
@@ -1,28 +1,133 @@
 package kv
 
-import "github.com/vansilich/db/pkg/btree"
+import (
+	"encoding/binary"
+	"hash/crc32"
+
+	"github.com/vansilich/db/pkg/btree"
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
 
 // `BTree.get`, read a page.
 func (db *KV) pageRead(ptr uint64) []byte {
+	if node, ok := db.page.updates[ptr]; ok {
+		return node // pending update
+	}
+	return db.pageReadFile(ptr)
+}
+
+// read a committed page, it's in the file or kept by the log
+func (db *KV) pageReadFile(ptr uint64) []byte {
+	return db.pageView().read(ptr)
+}
+
+func (db *KV) pageView() pageView {
+	return pageView{
+		chunks: db.mmap.chunks,
+		dirty:  db.page.dirty,
+		npages: db.page.flushed,
+		size:   db.page.size,
+		verify: !db.NoVerify,
+	}
+}
+
+// read-only view of the committed pages
+type pageView struct {
+	chunks [][]byte    // multiple mmaps, can be non-continuous
+	dirty  *dirtyPages // the pages not in the file yet
+	npages uint64      // number of pages in the file
+	size   int         // page size
+	verify bool        // verify page checksums
+}
+
+// read a page from the mmap view. panics with a `CorruptionError`
+// on a bad pointer or checksum, see `recoverCorruption`.
+func (v pageView) read(ptr uint64) []byte {
+	if ptr == 0 || ptr >= v.npages {
+		panic(&CorruptionError{Page: ptr, Reason: "pointer is out of range"})
+	}
+	if page, ok := v.dirty.get(ptr); ok {
+		return page
+	}
 	start := uint64(0)
-	for _, chunk := range db.mmap.chunks {
-		end := start + uint64(len(chunk))/btree.BTREE_PAGE_SIZE
+	for _, chunk := range v.chunks {
+		end := start + uint64(len(chunk)/v.size)
 		if ptr < end {
-			offset := btree.BTREE_PAGE_SIZE * (ptr - start)
-			return chunk[offset : offset+btree.BTREE_PAGE_SIZE]
+			offset := uint64(v.size) * (ptr - start)
+			page := chunk[offset : offset+uint64(v.size)]
+			if v.verify && pageChecksum(page) != pageStoredChecksum(page) {
+				panic(&CorruptionError{Page: ptr, Reason: "checksum mismatch"})
+			}
+			return page
 		}
 		start = end
 	}
-	panic("bad ptr")
+	panic(&CorruptionError{Page: ptr, Reason: "pointer is not mapped"})
+}
+
+// the checksum covers the whole page except the checksum itself
+func pageChecksum(page []byte) uint32 {
+	return crc32.Checksum(page[:btree.PageCap(len(page))], crcTable)
+}
+
+func pageStoredChecksum(page []byte) uint32 {
+	return binary.LittleEndian.Uint32(page[btree.PageCap(len(page)):])
+}
+
+func pageSetChecksum(page []byte) {
+	binary.LittleEndian.PutUint32(page[btree.PageCap(len(page)):], pageChecksum(page))
+}
+
+// `BTree.new`, allocate a new page. reuse a dropped page or a page from
+// the free list if possible.
+func (db *KV) pageAlloc(node []byte) uint64 {
+	if n := len(db.page.reusable) - db.page.nreused; n > 0 {
+		ptr := db.page.reusable[n-1]
+		db.page.nreused++
+		db.page.updates[ptr] = node
+		return ptr
+	}
+	if ptr := db.free.PopHead(); ptr != 0 {
+		db.page.updates[ptr] = node
+		return ptr
+	}
+	return db.pageAppend(node)
+}
+
+// `BTree.del`, free a page. a page kept by the log is reused once no
+// reader can see it, see `keepPages`.
+func (db *KV) pageFree(ptr uint64) {
+	if _, ok := db.page.dirty.get(ptr); ok {
+		db.page.freed = append(db.page.freed, ptr)
+		return
+	}
+	db.free.PushTail(ptr)
 }
 
+// `FreeList.new`, append a new page.
 func (db *KV) pageAppend(node []byte) uint64 {
-	ptr := db.page.flushed + uint64(len(db.page.temp)) // just append
-	db.page.temp = append(db.page.temp, node)
+	ptr := db.page.flushed + db.page.nappend // just append
+	db.page.nappend++
+	db.page.updates[ptr] = node
 	return ptr
 }
 
+// `FreeList.set`, update an existing page in place.
 func (db *KV) pageWrite(ptr uint64) []byte {
-	// TODO implement
-	return []byte{}
+	if node, ok := db.page.updates[ptr]; ok {
+		return node // pending update
+	}
+	node := make([]byte, db.page.size)
+	copy(node, db.pageReadFile(ptr)) // initialized from the file
+	db.page.updates[ptr] = node
+	return node
+}
+
+// drop the pages of a reverted update
+func discardPages(db *KV) {
+	db.page.nappend = 0
+	db.page.updates = map[uint64][]byte{}
+	db.page.freed = nil
+	db.page.nreused = 0
 }
@@ -0,0 +1,98 @@
+package kv
+
+import (
+	"github.com/vansilich/db/pkg/btree"
+)
+
+// read-only transaction. it pins the committed tree root and the mmap view,
+// so it sees a consistent snapshot while the writer commits new versions.
+// pages visible to it are not reused until it's ended.
+type KVReader struct {
+	db      *KV
+	version uint64
+	file    uint64 // see `KV.Compact`
+	tree    btree.BTree
+	done    bool
+}
+
+// begin a read-only transaction, it must be ended by `End`.
+func (db *KV) BeginRead() *KVReader {
+	db.reader.mu.Lock()
+	defer db.reader.mu.Unlock()
+
+	view := db.reader.view
+	r := &KVReader{
+		db:      db,
+		version: db.reader.version,
+		file:    db.reader.file,
+		tree: btree.BTree{
+			Root:     db.reader.root,
+			PageSize: view.size,
+			Cmp:      db.tree.Cmp, // fixed since `Open`
+			Get:      view.read,
+		},
+	}
+	db.reader.active[r.version]++
+	db.reader.files[r.file]++
+	return r
+}
+
+// end a read-only transaction
+func (r *KVReader) End() {
+	if r.done {
+		return
+	}
+	r.done = true
+
+	r.db.reader.mu.Lock()
+	defer r.db.reader.mu.Unlock()
+	if r.db.reader.active[r.version]--; r.db.reader.active[r.version] == 0 {
+		delete(r.db.reader.active, r.version)
+	}
+	if r.db.reader.files[r.file]--; r.db.reader.files[r.file] == 0 {
+		delete(r.db.reader.files, r.file)
+		unmapRetired(r.db)
+	}
+}
+
+func (r *KVReader) Get(key []byte) (val []byte, found bool, err error) {
+	if r.done {
+		return nil, false, ErrTxDone
+	}
+	defer recoverCorruption(&err)
+	return r.tree.Lookup(key)
+}
+
+func (r *KVReader) Scan(start, end []byte) (sc *Scanner, err error) {
+	if r.done {
+		return nil, ErrTxDone
+	}
+	defer recoverCorruption(&err)
+	return newScanner(&r.tree, start, end)
+}
+
+// make the latest commit visible to new readers
+func publish(db *KV) {
+	db.reader.mu.Lock()
+	defer db.reader.mu.Unlock()
+	publishLocked(db)
+}
+
+func publishLocked(db *KV) {
+	db.reader.root = db.tree.Root
+	db.reader.version = db.version
+	db.reader.view = db.pageView()
+}
+
+// the oldest version that is still visible to a reader
+func minReaderVersion(db *KV) uint64 {
+	db.reader.mu.Lock()
+	defer db.reader.mu.Unlock()
+	min := db.reader.version
+	for ver := range db.reader.active {
+		if ver < min {
+			min = ver
+		}
+	}
+	return min
+}
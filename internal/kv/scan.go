@@ -0,0 +1,66 @@
+package kv
+
+import (
+	"github.com/vansilich/db/pkg/btree"
+)
+
+// iterate over the keys in the range [start, end) in order.
+// nil `end` means no upper bound.
+type Scanner struct {
+	iter   *btree.BIter
+	tree   *btree.BTree // for the key order
+	end    []byte
+	reader *KVReader // the snapshot owned by the scanner, if any
+}
+
+// scan the latest committed version. the scanner must be closed.
+func (db *KV) Scan(start, end []byte) (*Scanner, error) {
+	r := db.BeginRead()
+	sc, err := r.Scan(start, end)
+	if err != nil {
+		r.End()
+		return nil, err
+	}
+	sc.reader = r
+	return sc, nil
+}
+
+func newScanner(tree *btree.BTree, start, end []byte) (*Scanner, error) {
+	iter, err := tree.SeekGE(start)
+	if err != nil {
+		return nil, err
+	}
+	return &Scanner{iter: iter, tree: tree, end: end}, nil
+}
+
+// within the range or not?
+func (sc *Scanner) Valid() bool {
+	if !sc.iter.Valid() {
+		return false
+	}
+	return sc.end == nil || sc.tree.Compare(sc.iter.Key(), sc.end) < 0
+}
+
+// fetch the current KV pair
+func (sc *Scanner) Key() []byte {
+	return sc.iter.Key()
+}
+
+// large values are read from overflow pages, which can fail
+func (sc *Scanner) Val() (val []byte, err error) {
+	defer recoverCorruption(&err)
+	return sc.iter.Val()
+}
+
+// move the underlying B+tree iterator
+func (sc *Scanner) Next() (err error) {
+	defer recoverCorruption(&err)
+	return sc.iter.Next()
+}
+
+// release the snapshot
+func (sc *Scanner) Close() {
+	if sc.reader != nil {
+		sc.reader.End()
+	}
+}
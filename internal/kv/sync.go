@@ -0,0 +1,150 @@
+package kv
+
+import (
+	"fmt"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// the durability of commits
+type SyncMode int
+
+const (
+	// `fsync` before and after the meta page update
+	SyncFull SyncMode = iota
+	// `fdatasync` instead of `fsync`, the file size is still synced
+	SyncData
+	// commits are written without the meta page, a background `fsync`
+	// makes them durable every `SyncInterval`. crash safe, but the
+	// commits since the last sync are lost on a crash.
+	SyncPeriodic
+	// never `fsync`, for bulk imports and tests. not crash safe.
+	SyncNone
+)
+
+// the default interval of `SyncPeriodic`
+const SYNC_INTERVAL = 100 * time.Millisecond
+
+func (mode SyncMode) String() string {
+	switch mode {
+	case SyncFull:
+		return "full"
+	case SyncData:
+		return "fdatasync"
+	case SyncPeriodic:
+		return "periodic"
+	case SyncNone:
+		return "none"
+	}
+	return fmt.Sprintf("SyncMode(%d)", int(mode))
+}
+
+func checkSyncMode(mode SyncMode) error {
+	if mode < SyncFull || mode > SyncNone {
+		return fmt.Errorf("bad sync mode %d", int(mode))
+	}
+	return nil
+}
+
+// flush the file to the disk, `SyncNone` does nothing
+func fileSync(db *KV, mode SyncMode) error {
+	switch mode {
+	case SyncNone:
+		return nil
+	case SyncData:
+		return unix.Fdatasync(db.fd)
+	default:
+		return syscall.Fsync(db.fd)
+	}
+}
+
+// make the commits written by `SyncPeriodic` durable. the meta page is
+// updated between 2 `fsync`s like `updateFile` does.
+func syncMeta(db *KV) error {
+	if !db.sync.pending || db.failed {
+		return nil // nothing to do, or the next commit rewrites the meta page
+	}
+	// the free list nodes updated by the dropped pages are kept too
+	releaseDropped(db)
+	if db.page.dirty != nil {
+		keepPages(db)
+	}
+	err := func() error {
+		if err := writeDirty(db); err != nil {
+			return err
+		}
+		if err := syscall.Fsync(db.fd); err != nil {
+			return err
+		}
+		if err := updateRoot(db); err != nil {
+			return err
+		}
+		return syscall.Fsync(db.fd)
+	}()
+	if err != nil {
+		// the on-disk meta page is in an unknown state
+		db.failed = true
+		return err
+	}
+	synced(db)
+	return nil
+}
+
+// the meta page is updated with all the commits
+func synced(db *KV) {
+	db.sync.pending = false
+	// pages freed by the synced commits can be reused now
+	db.free.SetMaxSeq()
+	// the kept pages are in the file, readers of the older commits
+	// keep the old set
+	db.page.dirty = nil
+	db.page.reusable = nil
+	db.page.nreused = 0
+	if db.wal.file != nil && resetLog(db) != nil {
+		// the records are skipped on replay, but new ones must wait
+		// for the next reset
+		db.wal.stale = true
+	}
+}
+
+// start the background sync of `SyncPeriodic`
+func startSyncer(db *KV) {
+	interval := db.SyncInterval
+	if interval <= 0 {
+		interval = SYNC_INTERVAL
+	}
+	db.sync.stop = make(chan struct{})
+	db.sync.done = make(chan struct{})
+	go func() {
+		defer close(db.sync.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-db.sync.stop:
+				return
+			case <-ticker.C:
+				db.writer.Lock()
+				_ = syncMeta(db) // retried by the next sync or commit
+				db.writer.Unlock()
+			}
+		}
+	}()
+}
+
+// stop the background sync and sync the remaining commits
+func stopSyncer(db *KV) error {
+	if db.sync.stop != nil {
+		close(db.sync.stop)
+		<-db.sync.done
+		db.sync.stop = nil
+	}
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	if err := syncMeta(db); err != nil {
+		return fmt.Errorf("sync: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package kv
+
+import (
+	"errors"
+
+	"github.com/vansilich/db/pkg/btree"
+)
+
+// KV transaction. updates are applied to a copy of the tree root
+// and are published by a single `updateFile` on commit.
+// there is only 1 write transaction at a time, `Begin` blocks until
+// the previous one is committed or aborted.
+type KVTX struct {
+	db   *KV
+	meta []byte      // the saved state for the rollback
+	tree btree.BTree // a copy of the tree with its own root
+	done bool        // committed or aborted
+	sync SyncMode    // the durability of the commit
+	// the updates for the write-ahead log
+	log   walOps
+	nolog bool // not logged, committed by a checkpoint
+}
+
+var ErrTxDone = errors.New("transaction is already committed or aborted")
+var ErrReadOnly = errors.New("the database is opened read-only")
+
+// begin a transaction. the transaction of a read-only database is
+// already done, its methods fail with ErrReadOnly.
+func (db *KV) Begin() *KVTX {
+	if db.readonly {
+		return &KVTX{db: db, done: true}
+	}
+	db.writer.Lock()
+	// pages freed by this transaction are tagged with the next version,
+	// pages still visible to readers are not reused.
+	db.free.SetVersions(db.version+1, minReaderVersion(db))
+	return &KVTX{
+		db:   db,
+		meta: saveMeta(db), // save the in-memory state (tree root)
+		tree: db.tree,
+		sync: db.Sync,
+	}
+}
+
+func (tx *KVTX) doneErr() error {
+	if tx.db.readonly {
+		return ErrReadOnly
+	}
+	return ErrTxDone
+}
+
+// override the durability of the commit. with `SyncPeriodic` and no
+// background sync, the commit is synced by the next synced one or `Close`.
+func (tx *KVTX) SetSync(mode SyncMode) error {
+	if tx.done {
+		return tx.doneErr()
+	}
+	if err := checkSyncMode(mode); err != nil {
+		return err
+	}
+	tx.sync = mode
+	return nil
+}
+
+// end a transaction: commit updates
+func (tx *KVTX) Commit() error {
+	if tx.done {
+		return tx.doneErr()
+	}
+	tx.done = true
+	defer tx.db.writer.Unlock()
+
+	tx.db.tree.Root = tx.tree.Root
+	tx.db.version++
+	var err error
+	if tx.db.WAL && !tx.nolog {
+		err = updateLog(tx.db, tx.meta, tx.sync, &tx.log)
+	} else {
+		err = updateOrRevert(tx.db, tx.meta, tx.sync)
+	}
+	if err != nil {
+		return err
+	}
+	publish(tx.db)
+	return nil
+}
+
+// end a transaction: rollback
+func (tx *KVTX) Abort() {
+	if tx.done {
+		return
+	}
+	tx.done = true
+	defer tx.db.writer.Unlock()
+
+	// nothing has been written, just discard pending pages
+	discardPages(tx.db)
+	revertMeta(tx.db, tx.meta)
+}
+
+// read-your-writes
+func (tx *KVTX) Get(key []byte) (val []byte, found bool, err error) {
+	if tx.done {
+		return nil, false, tx.doneErr()
+	}
+	defer recoverCorruption(&err)
+	return tx.tree.Lookup(key)
+}
+
+func (tx *KVTX) Scan(start, end []byte) (sc *Scanner, err error) {
+	if tx.done {
+		return nil, tx.doneErr()
+	}
+	defer recoverCorruption(&err)
+	return newScanner(&tx.tree, start, end)
+}
+
+// updates. the transaction should be aborted after an error.
+func (tx *KVTX) Set(key []byte, val []byte) (err error) {
+	if tx.done {
+		return tx.doneErr()
+	}
+	defer recoverCorruption(&err)
+	if err = tx.tree.Insert(key, val); err == nil {
+		tx.logOps(btree.Op{Key: key, Val: val})
+	}
+	return err
+}
+
+func (tx *KVTX) Del(key []byte) (deleted bool, err error) {
+	if tx.done {
+		return false, tx.doneErr()
+	}
+	defer recoverCorruption(&err)
+	if deleted, err = tx.tree.Delete(key); deleted {
+		tx.logOps(btree.Op{Key: key, Del: true})
+	}
+	return deleted, err
+}
+
+// record applied updates for the write-ahead log
+func (tx *KVTX) logOps(ops ...btree.Op) {
+	if !tx.db.WAL {
+		return
+	}
+	for _, op := range ops {
+		tx.log.add(op)
+	}
+}
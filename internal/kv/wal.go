@@ -0,0 +1,464 @@
+package kv
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/vansilich/db/pkg/btree"
+	"golang.org/x/sys/unix"
+)
+
+// Write-ahead log mode.
+//
+// A commit appends its updates to the log and is acknowledged after the
+// log is synced. Its pages are kept in memory for the readers and the next
+// commits, a kept page freed by a later commit is reused once no reader
+// can see it. A checkpoint writes the remaining pages and updates the meta
+// page, then the log is emptied. The commits after the last checkpoint are replayed from the
+// log on open, also without `WAL`.
+//
+// Structure of the log file (`KV.Path` + WAL_SUFFIX). The header has the
+// version of the checkpoint, the records continue from the next version:
+//
+// | sig | version | checksum | record | record | ...
+// | 16B |    8B   |    4B    |
+//
+// Structure of a record, the checksum covers everything after it:
+//
+// | size | checksum | version | nops | op | op | ...
+// |  4B  |    4B    |    8B   |  4B  |
+//
+// Structure of an op:
+//
+// | flags | klen | vlen | key | val |
+// |   1B  |  4B  |  4B  | ... | ... |
+
+const WAL_SIG = "BuildYourOwnWAL1"
+const WAL_SUFFIX = "-wal"
+const WAL_HEADER_SIZE = 28
+const WAL_RECORD_HEADER = 8
+const WAL_OP_HEADER = 9
+const WAL_OP_DEL = 1
+
+// the default log size that triggers a checkpoint
+const WAL_CHECKPOINT_SIZE = 4 << 20
+
+// the updates of a transaction in the log format
+type walOps struct {
+	n    uint32
+	data []byte
+}
+
+// the keys and values are copied
+func (w *walOps) add(op btree.Op) {
+	var hdr [WAL_OP_HEADER]byte
+	if op.Del {
+		hdr[0] = WAL_OP_DEL
+	}
+	binary.LittleEndian.PutUint32(hdr[1:], uint32(len(op.Key)))
+	binary.LittleEndian.PutUint32(hdr[5:], uint32(len(op.Val)))
+	w.data = append(w.data, hdr[:]...)
+	w.data = append(w.data, op.Key...)
+	w.data = append(w.data, op.Val...)
+	w.n++
+}
+
+func walRecord(version uint64, ops *walOps) []byte {
+	rec := make([]byte, WAL_RECORD_HEADER+12, WAL_RECORD_HEADER+12+len(ops.data))
+	binary.LittleEndian.PutUint64(rec[8:], version)
+	binary.LittleEndian.PutUint32(rec[16:], ops.n)
+	rec = append(rec, ops.data...)
+	binary.LittleEndian.PutUint32(rec[0:], uint32(len(rec)-WAL_RECORD_HEADER))
+	binary.LittleEndian.PutUint32(rec[4:], crc32.Checksum(rec[WAL_RECORD_HEADER:], crcTable))
+	return rec
+}
+
+// decode the next record. the end of the log or a torn record gives `io.EOF`.
+func walDecode(data []byte) (version uint64, ops []btree.Op, size int, err error) {
+	if len(data) < WAL_RECORD_HEADER {
+		return 0, nil, 0, io.EOF
+	}
+	size = WAL_RECORD_HEADER + int(binary.LittleEndian.Uint32(data[0:]))
+	if size < WAL_RECORD_HEADER+12 || size > len(data) {
+		return 0, nil, 0, io.EOF
+	}
+	rec := data[WAL_RECORD_HEADER:size]
+	if crc32.Checksum(rec, crcTable) != binary.LittleEndian.Uint32(data[4:]) {
+		return 0, nil, 0, io.EOF
+	}
+	version = binary.LittleEndian.Uint64(rec[0:])
+	n := binary.LittleEndian.Uint32(rec[8:])
+	rec = rec[12:]
+	for i := uint32(0); i < n; i++ {
+		if len(rec) < WAL_OP_HEADER {
+			return 0, nil, 0, errors.New("bad log record: truncated op")
+		}
+		klen := uint64(binary.LittleEndian.Uint32(rec[1:]))
+		vlen := uint64(binary.LittleEndian.Uint32(rec[5:]))
+		if uint64(len(rec)-WAL_OP_HEADER) < klen+vlen {
+			return 0, nil, 0, errors.New("bad log record: truncated op")
+		}
+		key := rec[WAL_OP_HEADER:][:klen]
+		val := rec[WAL_OP_HEADER+klen:][:vlen]
+		ops = append(ops, btree.Op{Key: key, Val: val, Del: rec[0]&WAL_OP_DEL != 0})
+		rec = rec[WAL_OP_HEADER+klen+vlen:]
+	}
+	if len(rec) != 0 {
+		return 0, nil, 0, errors.New("bad log record: trailing data")
+	}
+	return version, ops, size, nil
+}
+
+// open the log and replay the commits after the last checkpoint.
+// without `WAL`, a log left by the WAL mode is replayed and removed.
+func openLog(db *KV) error {
+	name := db.Path + WAL_SUFFIX
+	if !db.WAL {
+		if _, err := os.Stat(name); errors.Is(err, os.ErrNotExist) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("log: %w", err)
+		}
+	}
+	fd, err := createFileSync(name)
+	if err != nil {
+		return fmt.Errorf("log: %w", err)
+	}
+	db.wal.file = os.NewFile(uintptr(fd), name)
+	if err = replayLog(db); err != nil {
+		return err
+	}
+	if db.WAL {
+		return nil
+	}
+	// the log is empty now, it's not updated by the next commits
+	err = db.wal.file.Close()
+	db.wal.file = nil
+	if err != nil {
+		return fmt.Errorf("close log: %w", err)
+	}
+	if err = os.Remove(name); err != nil {
+		return fmt.Errorf("remove log: %w", err)
+	}
+	return nil
+}
+
+func replayLog(db *KV) error {
+	if db.version == 0 {
+		// a new file, the meta page is written before anything is logged.
+		// the log of a previous file is discarded.
+		tx := db.Begin()
+		tx.nolog = true
+		return tx.Commit()
+	}
+	data, err := io.ReadAll(db.wal.file)
+	if err != nil {
+		return fmt.Errorf("read log: %w", err)
+	}
+	records, err := readLog(db, data)
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return resetLog(db)
+	}
+
+	tx := db.Begin()
+	tx.nolog = true // already in the log
+	for _, ops := range records {
+		if err = tx.replay(ops); err != nil {
+			tx.Abort()
+			return fmt.Errorf("replay log: %w", err)
+		}
+	}
+	// the replayed commits are checkpointed as one, then the log is emptied
+	db.version += uint64(len(records)) - 1
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("replay log: %w", err)
+	}
+	return nil
+}
+
+// the records to replay on top of the meta page, in version order. the
+// records before it were checkpointed before the log was emptied, the
+// records after it must continue the version in the header.
+func readLog(db *KV, data []byte) ([][]btree.Op, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	// a bad header is from an interrupted `resetLog`, the records are
+	// from before the checkpoint then
+	base, ok := uint64(0), false
+	if len(data) >= WAL_HEADER_SIZE && string(data[:len(WAL_SIG)]) == WAL_SIG &&
+		crc32.Checksum(data[:24], crcTable) == binary.LittleEndian.Uint32(data[24:]) {
+		base, ok = binary.LittleEndian.Uint64(data[16:]), true
+	}
+
+	var records [][]btree.Op
+	version := db.version
+	for pos := WAL_HEADER_SIZE; pos < len(data); {
+		ver, ops, size, err := walDecode(data[pos:])
+		if err == io.EOF {
+			break // the tail of a crashed commit is discarded
+		}
+		if err != nil {
+			return nil, err
+		}
+		pos += size
+		if ver <= db.version {
+			continue // checkpointed before the log was emptied
+		}
+		if !ok {
+			return nil, errors.New("bad log: header")
+		}
+		if base != db.version {
+			return nil, fmt.Errorf("bad log: it continues the version %d, the database is at %d", base, db.version)
+		}
+		if ver != version+1 {
+			break // not a continuation of the checkpoint
+		}
+		records = append(records, ops)
+		version = ver
+	}
+	return records, nil
+}
+
+// a read-only open can't replay the log, the commits in it would be missing
+func checkLog(db *KV) error {
+	data, err := os.ReadFile(db.Path + WAL_SUFFIX)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("log: %w", err)
+	}
+	records, err := readLog(db, data)
+	if err != nil {
+		return err
+	}
+	if len(records) > 0 {
+		return errors.New("the log has commits to replay, open the database for writes first")
+	}
+	return nil
+}
+
+func (tx *KVTX) replay(ops []btree.Op) (err error) {
+	defer recoverCorruption(&err)
+	for _, op := range ops {
+		if op.Del {
+			_, err = tx.tree.Delete(op.Key)
+		} else {
+			err = tx.tree.Insert(op.Key, op.Val)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// empty the log after the meta page is updated, the header gets the new
+// version. the log is valid at every step, a failure leaves records that
+// are skipped on replay.
+func resetLog(db *KV) error {
+	var hdr [WAL_HEADER_SIZE]byte
+	copy(hdr[:], WAL_SIG)
+	binary.LittleEndian.PutUint64(hdr[16:], db.version)
+	binary.LittleEndian.PutUint32(hdr[24:], crc32.Checksum(hdr[:24], crcTable))
+	if err := db.wal.file.Truncate(0); err != nil {
+		return fmt.Errorf("truncate log: %w", err)
+	}
+	if _, err := db.wal.file.WriteAt(hdr[:], 0); err != nil {
+		return fmt.Errorf("write log: %w", err)
+	}
+	if err := db.wal.file.Sync(); err != nil {
+		return fmt.Errorf("fsync log: %w", err)
+	}
+	db.wal.size = WAL_HEADER_SIZE
+	db.wal.stale = false
+	return nil
+}
+
+// commit a transaction by the log, see `updateOrRevert` for the meta page
+func updateLog(db *KV, meta []byte, mode SyncMode, ops *walOps) error {
+	if db.failed || db.wal.stale {
+		// the meta page must be rewritten, which also checkpoints the log.
+		// records can't follow a header older than the meta page.
+		return updateOrRevert(db, meta, SyncFull)
+	}
+
+	size := db.wal.size
+	err := func() error {
+		rec := walRecord(db.version, ops)
+		if _, err := db.wal.file.WriteAt(rec, size); err != nil {
+			return fmt.Errorf("write log: %w", err)
+		}
+		db.wal.size += int64(len(rec))
+		return logSync(db, mode)
+	}()
+	if err != nil {
+		// remove the record so it's not replayed
+		_ = db.wal.file.Truncate(size)
+		db.wal.size = size
+		// the reverted state is not in the meta page, it must be written
+		// before freed pages are reused, see `updateOrRevert`.
+		db.failed = true
+		revertMeta(db, meta)
+		discardPages(db)
+		return err
+	}
+	keepPages(db)
+	db.sync.pending = true
+
+	limit := db.CheckpointSize
+	if limit <= 0 {
+		limit = WAL_CHECKPOINT_SIZE
+	}
+	if db.wal.size >= limit {
+		// the commit is durable in the log, a failed checkpoint is retried later
+		_ = syncMeta(db)
+	}
+	return nil
+}
+
+// the pages of the logged commits. the set is shared with the readers,
+// it's only updated by the writer. a checkpoint starts a new one, the
+// old one is kept by its readers.
+type dirtyPages struct {
+	mu    sync.RWMutex
+	pages map[uint64][]byte
+}
+
+// a dirty page freed by a commit
+type droppedPage struct {
+	ptr     uint64
+	version uint64
+}
+
+func (d *dirtyPages) get(ptr uint64) ([]byte, bool) {
+	if d == nil {
+		return nil, false
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	page, ok := d.pages[ptr]
+	return page, ok
+}
+
+// keep the pages of a logged commit in memory instead of writing them.
+// the dropped pages that are not visible to readers anymore are removed
+// and can be reused by the next commits.
+func keepPages(db *KV) {
+	if db.page.dirty == nil {
+		db.page.dirty = &dirtyPages{pages: map[uint64][]byte{}}
+	}
+	db.page.reusable = db.page.reusable[:len(db.page.reusable)-db.page.nreused]
+	db.page.nreused = 0
+	min := minReaderVersion(db)
+	dirty := db.page.dirty
+	dirty.mu.Lock()
+	for ptr, page := range db.page.updates {
+		dirty.pages[ptr] = page
+	}
+	kept := db.page.dropped[:0]
+	for _, page := range db.page.dropped {
+		if page.version <= min {
+			delete(dirty.pages, page.ptr)
+			db.page.reusable = append(db.page.reusable, page.ptr)
+		} else {
+			kept = append(kept, page)
+		}
+	}
+	dirty.mu.Unlock()
+	for _, ptr := range db.page.freed {
+		kept = append(kept, droppedPage{ptr: ptr, version: db.version})
+	}
+	db.page.dropped = kept
+	db.page.freed = nil
+	db.page.flushed += db.page.nappend
+	db.page.nappend = 0
+	db.page.updates = map[uint64][]byte{}
+}
+
+// add the dropped pages to the free list before the meta page is updated,
+// tagged with the versions that freed them
+func releaseDropped(db *KV) {
+	if db.page.dirty == nil {
+		return
+	}
+	min := minReaderVersion(db)
+	for _, ptr := range db.page.reusable[:len(db.page.reusable)-db.page.nreused] {
+		db.free.SetVersions(min, min)
+		db.free.PushTail(ptr)
+	}
+	for _, page := range db.page.dropped {
+		db.free.SetVersions(page.version, min)
+		db.free.PushTail(page.ptr)
+	}
+	for _, ptr := range db.page.freed {
+		db.free.SetVersions(db.version, min)
+		db.free.PushTail(ptr)
+	}
+	db.page.reusable = db.page.reusable[len(db.page.reusable)-db.page.nreused:]
+	db.page.dropped = nil
+	db.page.freed = nil
+}
+
+// write the pages kept by the log before the meta page references them.
+// the reused pages after the end of the file that are free again are
+// written as blank pages, they can become free list nodes.
+func writeDirty(db *KV) error {
+	if db.page.dirty == nil {
+		return nil
+	}
+	fsize, err := fileSize(db.fd)
+	if err != nil {
+		return err
+	}
+	pages := make(map[uint64][]byte, len(db.page.dirty.pages))
+	for ptr, page := range db.page.dirty.pages {
+		pages[ptr] = page
+	}
+	var blank []byte
+	for ptr := uint64(fsize) / uint64(db.page.size); ptr < db.page.flushed; ptr++ {
+		if _, ok := pages[ptr]; !ok {
+			if blank == nil {
+				blank = make([]byte, db.page.size)
+			}
+			pages[ptr] = blank
+		}
+	}
+	if err = extendMmap(db, int(db.page.flushed)*db.page.size); err != nil {
+		return err
+	}
+	return pwritePages(db, pages)
+}
+
+// flush the log to the disk. `SyncPeriodic` relies on the checkpoints.
+func logSync(db *KV, mode SyncMode) error {
+	var err error
+	switch mode {
+	case SyncNone, SyncPeriodic:
+		return nil
+	case SyncData:
+		err = unix.Fdatasync(int(db.wal.file.Fd()))
+	default:
+		err = db.wal.file.Sync()
+	}
+	if err != nil {
+		return fmt.Errorf("fsync log: %w", err)
+	}
+	return nil
+}
+
+// force a checkpoint: update the meta page and empty the log
+func (db *KV) Checkpoint() error {
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	return syncMeta(db)
+}
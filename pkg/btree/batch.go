@@ -0,0 +1,311 @@
+package btree
+
+import (
+	"errors"
+	"fmt"
+)
+
+// an update of `BTree.Update`
+type Op struct {
+	Key []byte
+	Val []byte
+	Del bool // delete the key, a missing key is ignored
+}
+
+// apply multiple updates in one descent. the ops must be sorted by key
+// without duplicates. keys in the same leaf share one copy of the path,
+// a node is split into as many nodes as needed.
+func (tree *BTree) Update(ops []Op) error {
+	for i, op := range ops {
+		if err := CheckKV(op.Key, op.Val); err != nil {
+			return err
+		}
+		if i > 0 && tree.Compare(ops[i-1].Key, op.Key) >= 0 {
+			return fmt.Errorf("key %q is not after the previous key %q", op.Key, ops[i-1].Key)
+		}
+	}
+	if len(ops) == 0 {
+		return nil
+	}
+
+	var root BNode
+	if tree.Root == 0 {
+		// an empty leaf with the dummy key, see `Insert`
+		root = make([]byte, tree.pageSize())
+		root.SetHeader(BNODE_LEAF, 1)
+		nodeAppendKV(root, 0, 0, nil, nil)
+	} else {
+		root = tree.Get(tree.Root)
+	}
+	nodes, err := tree.updateNode(root, ops)
+	if err != nil {
+		return err
+	}
+	if len(nodes) == 0 {
+		return errors.New("the dummy key is lost") // never happens
+	}
+	if tree.Root != 0 {
+		tree.Del(tree.Root)
+	}
+
+	// add levels until there is 1 root node
+	for len(nodes) > 1 {
+		items := make([]bulkItem, len(nodes))
+		for i, node := range nodes {
+			key, err := node.getKey(0)
+			if err != nil {
+				return err
+			}
+			items[i] = bulkItem{ptr: tree.New(node), key: key}
+		}
+		if nodes, err = tree.pack(BNODE_NODE, items); err != nil {
+			return err
+		}
+	}
+	// or remove levels with a single kid
+	node := nodes[0]
+	if node.btype() == BNODE_LEAF || node.nkeys() > 1 {
+		tree.Root = tree.New(node)
+		return nil
+	}
+	for node.btype() == BNODE_NODE && node.nkeys() == 1 {
+		if tree.Root, err = node.getPtr(0); err != nil {
+			return err
+		}
+		node = tree.Get(tree.Root)
+		if node.btype() == BNODE_NODE && node.nkeys() == 1 {
+			tree.Del(tree.Root)
+		}
+	}
+	return nil
+}
+
+// apply the ops to a subtree. returns the new nodes replacing it, they
+// are not allocated. there are no nodes if all the keys are deleted.
+func (tree *BTree) updateNode(node BNode, ops []Op) ([]BNode, error) {
+	switch node.btype() {
+	case BNODE_LEAF:
+		return tree.updateLeaf(node, ops)
+	case BNODE_NODE:
+		return tree.updateInternal(node, ops)
+	default:
+		return nil, errors.New("bad node type")
+	}
+}
+
+// merge the KVs of a leaf with the ops
+func (tree *BTree) updateLeaf(node BNode, ops []Op) ([]BNode, error) {
+	nkeys := node.nkeys()
+	items := make([]bulkItem, 0, int(nkeys)+len(ops))
+	i, j := uint16(0), 0
+	for i < nkeys || j < len(ops) {
+		cmp := -1 // the next KV is before the next op
+		if i == nkeys {
+			cmp = +1
+		} else if j < len(ops) {
+			key, err := node.getKey(i)
+			if err != nil {
+				return nil, err
+			}
+			cmp = tree.Compare(key, ops[j].Key)
+		}
+
+		if cmp < 0 {
+			// keep the KV
+			ptr, _ := node.getPtr(i)
+			key, _ := node.getKey(i)
+			val, err := node.getVal(i)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, bulkItem{ptr: ptr, key: key, val: val})
+			i++
+			continue
+		}
+		if cmp == 0 {
+			// the KV is updated or deleted
+			if err := tree.leafFree(node, i); err != nil {
+				return nil, err
+			}
+			i++
+		}
+		if !ops[j].Del {
+			ptr, val := tree.leafStore(ops[j].Val)
+			items = append(items, bulkItem{ptr: ptr, key: ops[j].Key, val: val})
+		}
+		j++
+	}
+	return tree.pack(BNODE_LEAF, items)
+}
+
+// a kid of an internal node, either unchanged or new
+type batchKid struct {
+	ptr  uint64 // an unchanged kid
+	key  []byte // and its separator key
+	node BNode  // a new kid, not allocated
+}
+
+// update the kids of an internal node
+func (tree *BTree) updateInternal(node BNode, ops []Op) ([]BNode, error) {
+	// the kid of every op
+	idxs := make([]uint16, len(ops))
+	for j, op := range ops {
+		idx, err := nodeLookupLE(node, op.Key, tree.Compare)
+		if err != nil {
+			return nil, err
+		}
+		idxs[j] = idx
+	}
+
+	nkeys := node.nkeys()
+	kids := make([]batchKid, 0, nkeys)
+	for i, j := uint16(0), 0; i < nkeys; i++ {
+		ptr, err := node.getPtr(i)
+		if err != nil {
+			return nil, err
+		}
+		key, err := node.getKey(i)
+		if err != nil {
+			return nil, err
+		}
+		// the ops of the kid are ops[j:end]
+		end := j
+		for end < len(ops) && idxs[end] == i {
+			end++
+		}
+		if end == j {
+			kids = append(kids, batchKid{ptr: ptr, key: key})
+			continue
+		}
+
+		updated, err := tree.updateNode(tree.Get(ptr), ops[j:end])
+		if err != nil {
+			return nil, err
+		}
+		tree.Del(ptr)
+		for _, kid := range updated {
+			kids = append(kids, batchKid{node: kid})
+		}
+		j = end
+	}
+
+	kids, err := tree.mergeKids(kids)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]bulkItem, len(kids))
+	for i, kid := range kids {
+		if kid.node == nil {
+			items[i] = bulkItem{ptr: kid.ptr, key: kid.key}
+			continue
+		}
+		// the separator key is a copy of the kid's first key
+		key, err := kid.node.getKey(0)
+		if err != nil {
+			return nil, err
+		}
+		items[i] = bulkItem{ptr: tree.New(kid.node), key: key}
+	}
+	return tree.pack(BNODE_NODE, items)
+}
+
+// merge small new kids with a sibling, like `shouldMerge` does for 1 key
+func (tree *BTree) mergeKids(kids []batchKid) ([]batchKid, error) {
+	for i := 0; i < len(kids); {
+		if kids[i].node == nil {
+			i++ // unchanged
+			continue
+		}
+		nbytes, err := kids[i].node.NBytes()
+		if err != nil {
+			return nil, err
+		}
+		if int(nbytes) > tree.pageSize()/4 {
+			i++
+			continue
+		}
+
+		// with the left sibling, or with the right one
+		left := -1
+		if i > 0 && tree.kidsFit(kids[i-1], kids[i]) {
+			left = i - 1
+		} else if i+1 < len(kids) && tree.kidsFit(kids[i], kids[i+1]) {
+			left = i
+		}
+		if left < 0 {
+			i++
+			continue
+		}
+		merged := BNode(make([]byte, tree.pageSize()))
+		if err = nodeMerge(merged, tree.kidNode(kids[left]), tree.kidNode(kids[left+1])); err != nil {
+			return nil, err
+		}
+		kids[left] = batchKid{node: merged}
+		kids = append(kids[:left+1], kids[left+2:]...)
+		i = left // the merged node may be merged again
+	}
+	return kids, nil
+}
+
+// can 2 kids be merged into 1 node?
+func (tree *BTree) kidsFit(a, b batchKid) bool {
+	aNbytes, errA := BNode(tree.kidPage(a)).NBytes()
+	bNbytes, errB := BNode(tree.kidPage(b)).NBytes()
+	if errA != nil || errB != nil {
+		return false
+	}
+	return int(aNbytes)+int(bNbytes)-HEADER <= tree.pageCap()
+}
+
+func (tree *BTree) kidPage(kid batchKid) BNode {
+	if kid.node != nil {
+		return kid.node
+	}
+	return tree.Get(kid.ptr)
+}
+
+// the kid to be merged, an unchanged kid is deallocated
+func (tree *BTree) kidNode(kid batchKid) BNode {
+	node := tree.kidPage(kid)
+	if kid.node == nil {
+		tree.Del(kid.ptr)
+	}
+	return node
+}
+
+// pack items into nodes of similar sizes, each fits on a page
+func (tree *BTree) pack(btype uint16, items []bulkItem) ([]BNode, error) {
+	if len(items) == 0 {
+		return nil, nil
+	}
+	total := 0
+	for _, item := range items {
+		total += 8 + 2 + 4 + len(item.key) + len(item.val)
+	}
+	space := tree.pageCap() - HEADER
+	nnodes := (total + space - 1) / space
+	target := (total + nnodes - 1) / nnodes
+
+	var nodes []BNode
+	for start := 0; start < len(items); {
+		end, nbytes := start, 0
+		for end < len(items) {
+			size := 8 + 2 + 4 + len(items[end].key) + len(items[end].val)
+			if end > start && (nbytes+size > space || nbytes >= target) {
+				break
+			}
+			nbytes += size
+			end++
+		}
+		node := BNode(make([]byte, tree.pageSize()))
+		node.SetHeader(btype, uint16(end-start))
+		for i, item := range items[start:end] {
+			if err := nodeAppendKV(node, uint16(i), item.ptr, item.key, item.val); err != nil {
+				return nil, err
+			}
+		}
+		nodes = append(nodes, node)
+		start = end
+	}
+	return nodes, nil
+}
@@ -1,19 +1,30 @@
 package btree
 
 import (
-	"bytes"
 	"errors"
+	"fmt"
 )
 
 const HEADER = 4
 
-const BTREE_PAGE_SIZE = 4096
+const BTREE_PAGE_SIZE = 4096 // the default page size
+// the page size is chosen per tree. it's limited by the 16-bit offsets
+// of the node format: a node can be up to 2 pages before it's split,
+// so 64K pages would overflow them.
+const BTREE_MIN_PAGE_SIZE = 4096
+const BTREE_MAX_PAGE_SIZE = 32768
+const BTREE_PAGE_CHECKSUM = 4 // the tail of a page is reserved for the checksum
 const BTREE_MAX_KEY_SIZE = 1000
-const BTREE_MAX_VAL_SIZE = 3000
+const BTREE_MAX_VAL_SIZE = 3000 // larger values are moved to overflow pages
 
 type BTree struct {
 	// pointer (a nonzero page number)
 	Root uint64
+	// page size in bytes, 0 means BTREE_PAGE_SIZE. up to BTREE_MAX_PAGE_SIZE
+	// (32K) because of the 16-bit node offsets, see CheckPageSize.
+	PageSize int
+	// the order of keys, the zero value means `Bytewise`
+	Cmp Comparator
 	// callbacks for managing on-disk pages
 	Get func(uint64) []byte // dereference a pointer
 	New func([]byte) uint64 // allocate a new page
@@ -33,6 +44,9 @@ type BTree struct {
 // * key-values - key-value pairs stored in this node.
 // If type=BNODE_NODE only keys without values are stored
 // * unused - unused space
+//
+// The last BTREE_PAGE_CHECKSUM bytes of a page are reserved for the storage layer
+// (page checksum), so a node never takes more than PageCap(page size) bytes.
 type BNode []byte
 
 const (
@@ -43,23 +57,104 @@ const (
 	SHOULD_MERGE_RIGHT_SIBLING = +1
 )
 
-func init() {
+// validate a page size
+func CheckPageSize(size int) error {
+	if size < BTREE_MIN_PAGE_SIZE || size > BTREE_MAX_PAGE_SIZE || size&(size-1) != 0 {
+		return fmt.Errorf("bad page size %d: must be a power of 2 from %d to %d, "+
+			"a node of 2 larger pages overflows the 16-bit offsets",
+			size, BTREE_MIN_PAGE_SIZE, BTREE_MAX_PAGE_SIZE)
+	}
 	node1max := HEADER + 8 + 2 + 4 + BTREE_MAX_KEY_SIZE + BTREE_MAX_VAL_SIZE
-	if node1max > BTREE_PAGE_SIZE {
-		panic("node1max > BTREE_PAGE_SIZE") // maximum KV
+	if node1max > PageCap(size) {
+		return fmt.Errorf("bad page size %d: the largest KV does not fit", size) // maximum KV
 	}
+	return nil
+}
+
+// the usable bytes of a page, without the checksum
+func PageCap(size int) int {
+	return size - BTREE_PAGE_CHECKSUM
+}
+
+func (tree *BTree) pageSize() int {
+	if tree.PageSize == 0 {
+		return BTREE_PAGE_SIZE
+	}
+	return tree.PageSize
+}
+
+func (tree *BTree) pageCap() int {
+	return PageCap(tree.pageSize())
+}
+
+// search the value by the key. returns false if the key is not found.
+func (tree *BTree) Lookup(key []byte) ([]byte, bool, error) {
+	if tree.Root == 0 {
+		return nil, false, nil // empty tree
+	}
+
+	node := BNode(tree.Get(tree.Root))
+	for {
+		idx, err := nodeLookupLE(node, key, tree.Compare)
+		if err != nil {
+			return nil, false, err
+		}
+
+		switch node.btype() {
+		case BNODE_NODE:
+			// internal node, descend into the kid node.
+			ptr, err := node.getPtr(idx)
+			if err != nil {
+				return nil, false, err
+			}
+			node = tree.Get(ptr)
+		case BNODE_LEAF:
+			// leaf, node.getKey(idx) <= key
+			idxkey, err := node.getKey(idx)
+			if err != nil {
+				return nil, false, err
+			}
+			if tree.Compare(key, idxkey) != 0 {
+				return nil, false, nil // not found
+			}
+
+			val, err := tree.leafVal(node, idx)
+			if err != nil {
+				return nil, false, err
+			}
+			return val, true, nil
+		default:
+			return nil, false, errors.New("bad node type")
+		}
+	}
+}
+
+// validate the sizes of a KV to be inserted
+func CheckKV(key, val []byte) error {
+	if len(key) == 0 || len(key) > BTREE_MAX_KEY_SIZE {
+		return errors.New("bad key size")
+	}
+	if len(val) > BTREE_MAX_OVERFLOW_SIZE {
+		return errors.New("bad value size")
+	}
+	return nil
 }
 
 func (tree *BTree) Insert(key []byte, val []byte) error {
+	if err := CheckKV(key, val); err != nil {
+		return err
+	}
+
 	if tree.Root == 0 {
 		// create the first node
-		root := BNode(make([]byte, BTREE_PAGE_SIZE))
+		root := BNode(make([]byte, tree.pageSize()))
 		root.SetHeader(BNODE_LEAF, 2)
 		// a dummy key, this makes the tree cover the whole key space.
 		// thus a lookup can always find a containing node.
 		// (used for nodeLookupLE())
 		nodeAppendKV(root, 0, 0, nil, nil)
-		nodeAppendKV(root, 1, 0, key, val)
+		ptr, val := tree.leafStore(val)
+		nodeAppendKV(root, 1, ptr, key, val)
 		tree.Root = tree.New(root)
 		return nil
 	}
@@ -69,7 +164,7 @@ func (tree *BTree) Insert(key []byte, val []byte) error {
 		return err
 	}
 
-	nsplit, splitedNodes, err := nodeSplit3(node)
+	nsplit, splitedNodes, err := nodeSplit3(node, tree.pageSize())
 	if err != nil {
 		return err
 	}
@@ -78,28 +173,25 @@ func (tree *BTree) Insert(key []byte, val []byte) error {
 
 	if nsplit == 1 {
 		tree.Root = tree.New(splitedNodes[0])
-	} else {
-		// the root was split, add a new level.
-		root := BNode(make([]byte, BTREE_PAGE_SIZE))
-		root.SetHeader(BNODE_NODE, nsplit)
-		for i, knode := range splitedNodes[:nsplit] {
-			ptr := tree.New(knode)
-			if i == 0 {
-				if err = nodeAppendKV(root, uint16(i), ptr, nil, nil); err != nil {
-					return err
-				}
-			} else {
-				key, err := knode.getKey(0)
-				if err != nil {
-					return err
-				}
-				if err = nodeAppendKV(root, uint16(i), ptr, key, nil); err != nil {
-					return err
-				}
-			}
+		return nil
+	}
+	return tree.newRoot(splitedNodes[:nsplit])
+}
+
+// the root was split, add a new level.
+func (tree *BTree) newRoot(kids []BNode) error {
+	root := BNode(make([]byte, tree.pageSize()))
+	root.SetHeader(BNODE_NODE, uint16(len(kids)))
+	for i, knode := range kids {
+		key, err := knode.getKey(0)
+		if err != nil {
+			return err
+		}
+		if err = nodeAppendKV(root, uint16(i), tree.New(knode), key, nil); err != nil {
+			return err
 		}
-		tree.Root = tree.New(root)
 	}
+	tree.Root = tree.New(root)
 	return nil
 }
 
@@ -109,10 +201,10 @@ func (tree *BTree) Insert(key []byte, val []byte) error {
 func (tree *BTree) treeInsert(node BNode, key, val []byte) (BNode, error) {
 	// the result node.
 	// it's allowed to be bigger than 1 page and will be split if so
-	var new BNode = make([]byte, 2*BTREE_PAGE_SIZE)
+	var new BNode = make([]byte, 2*tree.pageSize())
 
 	// where to insert the key?
-	idx, err := nodeLookupLE(node, key)
+	idx, err := nodeLookupLE(node, key, tree.Compare)
 	if err != nil {
 		return new, err
 	}
@@ -131,13 +223,19 @@ func (tree *BTree) treeInsert(node BNode, key, val []byte) (BNode, error) {
 			return new, err
 		}
 
-		if bytes.Equal(key, idxkey) {
+		if tree.Compare(key, idxkey) == 0 {
 			// found the key, update it.
-			leafUpdate(new, node, idx, key, val)
+			if err = tree.leafFree(node, idx); err != nil {
+				return new, err
+			}
+			ptr, val := tree.leafStore(val)
+			if err = leafUpdate(new, node, idx, ptr, key, val); err != nil {
+				return new, err
+			}
 		} else {
 			// insert it after the position.
-			err = leafInsert(new, node, idx+1, key, val)
-			if err != nil {
+			ptr, val := tree.leafStore(val)
+			if err = leafInsert(new, node, idx+1, ptr, key, val); err != nil {
 				return new, err
 			}
 		}
@@ -148,30 +246,49 @@ func (tree *BTree) treeInsert(node BNode, key, val []byte) (BNode, error) {
 	return new, nil
 }
 
-// TODO implement
+// delete a key from the tree. returns false if the key is not found.
 func (tree *BTree) Delete(key []byte) (bool, error) {
-	if tree.Root == 0 {
-		return false, errors.New("root node is not initialized")
+	if tree.Root == 0 || len(key) == 0 {
+		return false, nil // empty tree or the dummy key
 	}
 
-	node, err := tree.treeDelete(tree.Get(tree.Root), key)
+	updated, err := tree.treeDelete(tree.Get(tree.Root), key)
 	if err != nil {
 		return false, err
 	}
+	if len(updated) == 0 {
+		return false, nil // not found
+	}
 
-	return true, nil
+	tree.Del(tree.Root)
+	// the root grows if its separator keys get longer
+	nsplit, split, err := nodeSplit3(updated, tree.pageSize())
+	if err != nil {
+		return false, err
+	}
+	switch {
+	case nsplit > 1:
+		err = tree.newRoot(split[:nsplit])
+	case updated.btype() == BNODE_NODE && updated.nkeys() == 1:
+		// remove a level
+		tree.Root, err = updated.getPtr(0)
+	default:
+		tree.Root = tree.New(split[0])
+	}
+	return err == nil, err
 }
 
-// delete a key from the tree
-// TODO разобраться с аллокацией/деалокацией
-// TODO обрабатывать пустые новые ноды
+// delete a key from a node, the result might be empty or bigger than 1 page.
+// returns an empty slice if the key is not found.
+// the caller is responsible for deallocating the input node
+// and splitting and allocating the result node.
 func (tree *BTree) treeDelete(node BNode, key []byte) (BNode, error) {
 	var err error = nil
 	// the result node.
 	var new BNode
 
-	// where to insert the key?
-	idx, err := nodeLookupLE(node, key)
+	// where to delete the key from?
+	idx, err := nodeLookupLE(node, key, tree.Compare)
 	if err != nil {
 		return new, err
 	}
@@ -179,14 +296,26 @@ func (tree *BTree) treeDelete(node BNode, key []byte) (BNode, error) {
 	// act depending on the node type
 	switch node.btype() {
 	case BNODE_NODE:
-		// internal node, insert it to a kid node.
+		// internal node, delete it from a kid node.
 		new, err = nodeDelete(tree, node, idx, key)
 		if err != nil {
 			return new, err
 		}
 	case BNODE_LEAF:
+		// leaf, node.getKey(idx) <= key
+		idxkey, err := node.getKey(idx)
+		if err != nil {
+			return new, err
+		}
+		if tree.Compare(key, idxkey) != 0 {
+			return new, nil // not found
+		}
+
+		if err = tree.leafFree(node, idx); err != nil {
+			return new, err
+		}
 		// the result node.
-		new = make([]byte, BTREE_PAGE_SIZE)
+		new = make([]byte, tree.pageSize())
 		if err = leafDelete(new, node, idx); err != nil {
 			return new, err
 		}
@@ -204,7 +333,7 @@ func (tree *BTree) shouldMerge(parent BNode, idx uint16, updated BNode) (int, BN
 		return SHOULD_MERGE_NO, BNode{}, err
 	}
 
-	if updNbytes > BTREE_PAGE_SIZE/4 {
+	if int(updNbytes) > tree.pageSize()/4 {
 		return SHOULD_MERGE_NO, BNode{}, nil
 	}
 
@@ -219,8 +348,8 @@ func (tree *BTree) shouldMerge(parent BNode, idx uint16, updated BNode) (int, BN
 		if err != nil {
 			return SHOULD_MERGE_NO, BNode{}, err
 		}
-		merged := sibNbytes + updNbytes - HEADER
-		if merged <= BTREE_PAGE_SIZE {
+		merged := int(sibNbytes) + int(updNbytes) - HEADER
+		if merged <= tree.pageCap() {
 			return SHOULD_MERGE_LEFT_SIBLING, sibling, nil
 		}
 	}
@@ -235,8 +364,8 @@ func (tree *BTree) shouldMerge(parent BNode, idx uint16, updated BNode) (int, BN
 		if err != nil {
 			return SHOULD_MERGE_NO, BNode{}, err
 		}
-		merged := sibNbytes + updNbytes - HEADER
-		if merged <= BTREE_PAGE_SIZE {
+		merged := int(sibNbytes) + int(updNbytes) - HEADER
+		if merged <= tree.pageCap() {
 			return SHOULD_MERGE_RIGHT_SIBLING, sibling, nil
 		}
 	}
@@ -0,0 +1,163 @@
+package btree
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The default fill factor of `BTree.BulkLoad`. Full nodes are split on
+// the next insertion, so some space is left for later updates.
+const BTREE_BULK_FILL = 0.9
+
+// builds a tree bottom-up from KVs in sorted order. nodes are filled
+// from left to right and written once by `tree.New`, a node is written
+// when the next KV doesn't fit, and its first key is added to the parent level.
+type BulkLoader struct {
+	tree   *BTree
+	limit  int          // max bytes of a node
+	levels []*bulkLevel // the unwritten nodes, from the leaves up
+	last   []byte       // the last key
+	nkeys  uint64
+}
+
+// the KVs of the unwritten node of a level
+type bulkLevel struct {
+	items  []bulkItem
+	nbytes int // the node size
+	nodes  int // written nodes
+}
+
+type bulkItem struct {
+	ptr      uint64
+	key, val []byte
+}
+
+// start to replace the content of the tree. `fill` is the fraction of
+// a page used by a node, from 0.5 to 1. the tree is updated by `Finish`.
+func (tree *BTree) BulkLoad(fill float64) (*BulkLoader, error) {
+	if fill < 0.5 || fill > 1 {
+		return nil, fmt.Errorf("bad fill factor %g", fill)
+	}
+	b := &BulkLoader{tree: tree, limit: int(fill * float64(tree.pageCap()))}
+	// the dummy key of the leftmost leaf, see `Insert`
+	b.add(0, bulkItem{key: []byte{}, val: []byte{}})
+	return b, nil
+}
+
+// add a KV. the keys must be in ascending order without duplicates.
+func (b *BulkLoader) Add(key, val []byte) error {
+	if err := CheckKV(key, val); err != nil {
+		return err
+	}
+	if b.nkeys > 0 && b.tree.Compare(b.last, key) >= 0 {
+		return fmt.Errorf("key %q is not after the previous key %q", key, b.last)
+	}
+	key = append([]byte(nil), key...)
+	ptr, stored := b.tree.leafStore(val)
+	if ptr == 0 {
+		stored = append([]byte(nil), val...)
+	}
+	b.last = key
+	b.nkeys++
+	return b.add(0, bulkItem{ptr: ptr, key: key, val: stored})
+}
+
+// write the remaining nodes and replace the tree. the pages of the old
+// tree are deallocated.
+func (b *BulkLoader) Finish() error {
+	old := b.tree.Root
+	root := uint64(0)
+	for i := 0; i < len(b.levels) && b.nkeys > 0; i++ {
+		level := b.levels[i]
+		if i == len(b.levels)-1 && level.nodes == 0 {
+			// the only node of the top level
+			node, err := b.build(i)
+			if err != nil {
+				return err
+			}
+			root = b.tree.New(node)
+			break
+		}
+		if err := b.flush(i); err != nil {
+			return err
+		}
+	}
+	if old != 0 {
+		if err := b.tree.free(old); err != nil {
+			return err
+		}
+	}
+	b.tree.Root = root
+	return nil
+}
+
+// add an item to a level, the unwritten node is written if it's full
+func (b *BulkLoader) add(i int, item bulkItem) error {
+	if i == len(b.levels) {
+		b.levels = append(b.levels, &bulkLevel{})
+	}
+	level := b.levels[i]
+	size := 8 + 2 + 4 + len(item.key) + len(item.val)
+	if len(level.items) > 0 && HEADER+level.nbytes+size > b.limit {
+		if err := b.flush(i); err != nil {
+			return err
+		}
+	}
+	level.items = append(level.items, item)
+	level.nbytes += size
+	return nil
+}
+
+// write the unwritten node of a level and link it to the parent level
+func (b *BulkLoader) flush(i int) error {
+	node, err := b.build(i)
+	if err != nil {
+		return err
+	}
+	level := b.levels[i]
+	first := level.items[0].key
+	level.items, level.nbytes = nil, 0
+	level.nodes++
+	return b.add(i+1, bulkItem{ptr: b.tree.New(node), key: first})
+}
+
+func (b *BulkLoader) build(i int) (BNode, error) {
+	btype := uint16(BNODE_NODE)
+	if i == 0 {
+		btype = BNODE_LEAF
+	}
+	items := b.levels[i].items
+	node := BNode(make([]byte, b.tree.pageSize()))
+	node.SetHeader(btype, uint16(len(items)))
+	for idx, item := range items {
+		if err := nodeAppendKV(node, uint16(idx), item.ptr, item.key, item.val); err != nil {
+			return nil, err
+		}
+	}
+	return node, nil
+}
+
+// deallocate all pages of a subtree
+func (tree *BTree) free(ptr uint64) error {
+	node := BNode(tree.Get(ptr))
+	for idx := uint16(0); idx < node.nkeys(); idx++ {
+		switch node.btype() {
+		case BNODE_NODE:
+			kid, err := node.getPtr(idx)
+			if err != nil {
+				return err
+			}
+			if err = tree.free(kid); err != nil {
+				return err
+			}
+		case BNODE_LEAF:
+			if err := tree.leafFree(node, idx); err != nil {
+				return err
+			}
+		default:
+			return errors.New("bad node type")
+		}
+	}
+	tree.Del(ptr)
+	return nil
+}
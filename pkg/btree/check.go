@@ -0,0 +1,194 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// a problem found by `BTree.Check`
+type Violation struct {
+	Page uint64
+	Msg  string
+}
+
+func (v Violation) String() string {
+	return fmt.Sprintf("page %d: %s", v.Page, v.Msg)
+}
+
+type CheckStats struct {
+	Depth    int    // number of levels
+	Nodes    uint64 // internal nodes
+	Leaves   uint64 // leaf nodes
+	Keys     uint64 // keys in leaves, without the dummy key
+	Overflow uint64 // overflow pages
+}
+
+// walk the tree from the root and validate every node.
+// `visit` is called before a page is read, an error skips the page.
+func (tree *BTree) Check(visit func(ptr uint64) error) (CheckStats, []Violation) {
+	c := checker{tree: tree, visit: visit}
+	if tree.Root != 0 {
+		// the dummy key is the first key of the leftmost nodes
+		c.checkNode(tree.Root, 1, []byte{}, nil)
+	}
+	return c.stats, c.violations
+}
+
+type checker struct {
+	tree       *BTree
+	visit      func(ptr uint64) error
+	stats      CheckStats
+	violations []Violation
+}
+
+func (c *checker) report(ptr uint64, format string, args ...interface{}) {
+	c.violations = append(c.violations, Violation{Page: ptr, Msg: fmt.Sprintf(format, args...)})
+}
+
+// check a subtree. `first` is the separator key in the parent node,
+// `hi` is the next separator key (exclusive bound), nil if there is none.
+func (c *checker) checkNode(ptr uint64, depth int, first, hi []byte) {
+	if err := c.visit(ptr); err != nil {
+		c.report(ptr, "%s", err.Error())
+		return
+	}
+	node := BNode(c.tree.Get(ptr))
+	keys, err := checkLayout(node, c.tree.pageSize())
+	if err != nil {
+		c.report(ptr, "%s", err.Error())
+		return
+	}
+
+	// key order
+	if !bytes.Equal(keys[0], first) {
+		c.report(ptr, "the first key %q does not match the separator key %q", keys[0], first)
+	}
+	for i := 1; i < len(keys); i++ {
+		if c.tree.Compare(keys[i-1], keys[i]) >= 0 {
+			c.report(ptr, "keys %d and %d are not in order", i-1, i)
+		}
+	}
+	if hi != nil && c.tree.Compare(keys[len(keys)-1], hi) >= 0 {
+		c.report(ptr, "the last key %q is out of the parent range", keys[len(keys)-1])
+	}
+
+	switch node.btype() {
+	case BNODE_LEAF:
+		if c.stats.Depth == 0 {
+			c.stats.Depth = depth
+		} else if c.stats.Depth != depth {
+			c.report(ptr, "the leaf is at level %d, other leaves are at level %d", depth, c.stats.Depth)
+		}
+		for i, key := range keys {
+			if len(key) > BTREE_MAX_KEY_SIZE {
+				c.report(ptr, "key %d is too large: %d bytes", i, len(key))
+			}
+			val, _ := node.getVal(uint16(i))
+			if kid, _ := node.getPtr(uint16(i)); kid != 0 {
+				c.checkOverflow(ptr, i, kid, val)
+			} else if len(val) > BTREE_MAX_VAL_SIZE {
+				c.report(ptr, "value %d is too large: %d bytes", i, len(val))
+			}
+		}
+		c.stats.Leaves++
+		c.stats.Keys += uint64(len(keys))
+		if len(first) == 0 {
+			c.stats.Keys-- // the dummy key
+		}
+	case BNODE_NODE:
+		c.stats.Nodes++
+		for i, key := range keys {
+			if val, _ := node.getVal(uint16(i)); len(val) != 0 {
+				c.report(ptr, "key %d of an internal node has a value", i)
+			}
+			kidHi := hi
+			if i+1 < len(keys) {
+				kidHi = keys[i+1]
+			}
+			kid, _ := node.getPtr(uint16(i))
+			c.checkNode(kid, depth+1, key, kidHi)
+		}
+	}
+}
+
+// check the overflow pages of the value `i` in the leaf `leaf`
+func (c *checker) checkOverflow(leaf uint64, i int, ptr uint64, val []byte) {
+	if len(val) != 8 {
+		c.report(leaf, "value %d has an overflow pointer but %d bytes inline", i, len(val))
+		return
+	}
+	size := binary.LittleEndian.Uint64(val)
+	if size <= BTREE_MAX_VAL_SIZE || size > BTREE_MAX_OVERFLOW_SIZE {
+		c.report(leaf, "value %d has a bad overflow size %d", i, size)
+		return
+	}
+	got := uint64(0)
+	for ptr != 0 && got < size {
+		if err := c.visit(ptr); err != nil {
+			c.report(ptr, "%s", err.Error())
+			return
+		}
+		page, err := overflowPage(c.tree.Get(ptr), ptr)
+		if err == nil && len(page.data) > overflowCap(c.tree.pageSize()) {
+			err = fmt.Errorf("page %d: bad overflow page size %d", ptr, len(page.data))
+		}
+		if err != nil {
+			c.report(ptr, "%s", err.Error())
+			return
+		}
+		c.stats.Overflow++
+		got += uint64(len(page.data))
+		ptr = page.next
+	}
+	if got != size || ptr != 0 {
+		c.report(leaf, "the overflow chain of value %d does not match its size %d", i, size)
+	}
+}
+
+// validate the node header, offsets and KV positions. returns the keys.
+func checkLayout(node BNode, pageSize int) ([][]byte, error) {
+	pageCap := PageCap(pageSize)
+	if len(node) < pageCap {
+		return nil, fmt.Errorf("the page is too short: %d bytes", len(node))
+	}
+	if t := node.btype(); t != BNODE_NODE && t != BNODE_LEAF {
+		return nil, fmt.Errorf("bad node type %d", t)
+	}
+	nkeys := int(node.nkeys())
+	if nkeys == 0 {
+		return nil, errors.New("the node is empty")
+	}
+	kvStart := HEADER + 8*nkeys + 2*nkeys
+	if kvStart > pageCap {
+		return nil, fmt.Errorf("too many keys: %d", nkeys)
+	}
+
+	keys := make([][]byte, nkeys)
+	offset := 0
+	for i := 0; i <= nkeys; i++ {
+		got, _ := node.GetOffset(uint16(i))
+		if int(got) != offset {
+			return nil, fmt.Errorf("bad offset %d of KV %d, expected %d", got, i, offset)
+		}
+		if i == nkeys {
+			break
+		}
+		pos := kvStart + offset
+		if pos+4 > pageCap {
+			return nil, fmt.Errorf("KV %d is out of the page", i)
+		}
+		klen := int(binary.LittleEndian.Uint16(node[pos:]))
+		vlen := int(binary.LittleEndian.Uint16(node[pos+2:]))
+		if pos+4+klen+vlen > pageCap {
+			return nil, fmt.Errorf("KV %d is out of the page", i)
+		}
+		keys[i] = node[pos+4:][:klen]
+		offset += 4 + klen + vlen
+	}
+	if nbytes, _ := node.NBytes(); int(nbytes) > pageCap {
+		return nil, fmt.Errorf("the node is too large: %d bytes", nbytes)
+	}
+	return keys, nil
+}
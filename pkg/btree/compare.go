@@ -0,0 +1,72 @@
+package btree
+
+import "bytes"
+
+// the order of keys. the name identifies the order in a database file,
+// a file must never be opened with a different order.
+type Comparator struct {
+	Name    string
+	Compare func(a, b []byte) int // like bytes.Compare
+}
+
+// the built-in orders
+var (
+	Bytewise        = Comparator{Name: "bytewise", Compare: bytes.Compare}
+	Reverse         = Comparator{Name: "reverse", Compare: reverseCompare}
+	CaseInsensitive = Comparator{Name: "case-insensitive", Compare: caseInsensitiveCompare}
+)
+
+// find a built-in comparator by its name
+func ComparatorByName(name string) (Comparator, bool) {
+	for _, cmp := range []Comparator{Bytewise, Reverse, CaseInsensitive} {
+		if cmp.Name == name {
+			return cmp, true
+		}
+	}
+	return Comparator{}, false
+}
+
+// the comparator of the tree, the zero value means `Bytewise`
+func (tree *BTree) Comparator() Comparator {
+	if tree.Cmp.Compare == nil {
+		return Bytewise
+	}
+	return tree.Cmp
+}
+
+// compare keys in the order of the tree. the empty key is the dummy key,
+// it's less than any other key in any order.
+func (tree *BTree) Compare(a, b []byte) int {
+	if len(a) == 0 || len(b) == 0 {
+		return len(a) - len(b)
+	}
+	if tree.Cmp.Compare == nil {
+		return bytes.Compare(a, b)
+	}
+	return tree.Cmp.Compare(a, b)
+}
+
+func reverseCompare(a, b []byte) int {
+	return bytes.Compare(b, a)
+}
+
+// ASCII letters are compared without the case
+func caseInsensitiveCompare(a, b []byte) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		ca, cb := lower(a[i]), lower(b[i])
+		if ca != cb {
+			if ca < cb {
+				return -1
+			}
+			return +1
+		}
+	}
+	return len(a) - len(b)
+}
+
+func lower(c byte) byte {
+	if 'A' <= c && c <= 'Z' {
+		return c + ('a' - 'A')
+	}
+	return c
+}
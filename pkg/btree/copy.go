@@ -0,0 +1,116 @@
+package btree
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// a copy of the tree renumbered to consecutive pages in key order:
+// every node is followed by its subtrees, and a leaf by its overflow
+// pages. it's planned by `BTree.Copy` and written by `TreeCopy.Write`.
+type TreeCopy struct {
+	tree  *BTree
+	order []uint64          // the pages in the new order
+	ptrs  map[uint64]uint64 // the old pointer -> the new pointer
+}
+
+// plan a copy of the tree to the pages from `base`. the tree must not
+// change until the copy is written.
+func (tree *BTree) Copy(base uint64) (*TreeCopy, error) {
+	c := &TreeCopy{tree: tree, ptrs: map[uint64]uint64{}}
+	if tree.Root == 0 {
+		return c, nil
+	}
+	if err := c.plan(tree.Root, base); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *TreeCopy) add(ptr, base uint64) error {
+	if _, ok := c.ptrs[ptr]; ok {
+		return fmt.Errorf("page %d is referenced twice", ptr)
+	}
+	c.ptrs[ptr] = base + uint64(len(c.order))
+	c.order = append(c.order, ptr)
+	return nil
+}
+
+func (c *TreeCopy) plan(ptr, base uint64) error {
+	if err := c.add(ptr, base); err != nil {
+		return err
+	}
+	node := BNode(c.tree.Get(ptr))
+	switch node.btype() {
+	case BNODE_LEAF:
+		for i := uint16(0); i < node.nkeys(); i++ {
+			next, err := node.getPtr(i)
+			if err != nil {
+				return err
+			}
+			for next != 0 {
+				if err = c.add(next, base); err != nil {
+					return err
+				}
+				page, err := overflowPage(c.tree.Get(next), next)
+				if err != nil {
+					return err
+				}
+				next = page.next
+			}
+		}
+	case BNODE_NODE:
+		for i := uint16(0); i < node.nkeys(); i++ {
+			kid, err := node.getPtr(i)
+			if err != nil {
+				return err
+			}
+			if err = c.plan(kid, base); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("page %d: bad node type %d", ptr, node.btype())
+	}
+	return nil
+}
+
+// the root of the copy, 0 for an empty tree
+func (c *TreeCopy) Root() uint64 {
+	return c.ptrs[c.tree.Root]
+}
+
+// the number of pages of the copy
+func (c *TreeCopy) Pages() int {
+	return len(c.order)
+}
+
+// pass the renumbered pages to `emit` in order. the pages are new copies.
+func (c *TreeCopy) Write(emit func(page []byte) error) error {
+	for _, ptr := range c.order {
+		page := append([]byte(nil), c.tree.Get(ptr)...)
+		node := BNode(page)
+		switch node.btype() {
+		case BNODE_LEAF, BNODE_NODE:
+			for i := uint16(0); i < node.nkeys(); i++ {
+				old, err := node.getPtr(i)
+				if err != nil {
+					return err
+				}
+				if old != 0 {
+					if err = node.setPtr(i, c.ptrs[old]); err != nil {
+						return err
+					}
+				}
+			}
+		case BNODE_OVERFLOW:
+			if next := binary.LittleEndian.Uint64(page[4:]); next != 0 {
+				binary.LittleEndian.PutUint64(page[4:], c.ptrs[next])
+			}
+		}
+		if err := emit(page); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package btree
+
+// the decoded content of a node, for debugging tools
+type NodeDump struct {
+	Type    uint16
+	NKeys   uint16
+	Ptrs    []uint64
+	Offsets []uint16 // offsets of KV pairs, including the end
+	Keys    [][]byte
+	Vals    [][]byte
+}
+
+// decode a node, which is a whole page. returns an error if the layout is damaged.
+func DumpNode(node BNode) (NodeDump, error) {
+	keys, err := checkLayout(node, len(node))
+	if err != nil {
+		return NodeDump{}, err
+	}
+
+	dump := NodeDump{Type: node.btype(), NKeys: node.nkeys(), Keys: keys}
+	for i := uint16(0); i <= dump.NKeys; i++ {
+		offset, _ := node.GetOffset(i)
+		dump.Offsets = append(dump.Offsets, offset)
+		if i == dump.NKeys {
+			break
+		}
+		ptr, _ := node.getPtr(i)
+		val, _ := node.getVal(i)
+		dump.Ptrs = append(dump.Ptrs, ptr)
+		dump.Vals = append(dump.Vals, val)
+	}
+	return dump, nil
+}
+
+// decode an overflow page, which is a whole page. returns the next page
+// of the chain and the data.
+func DumpOverflow(page []byte) (uint64, []byte, error) {
+	o, err := overflowPage(page, 0)
+	if err != nil {
+		return 0, nil, err
+	}
+	return o.next, o.data, nil
+}
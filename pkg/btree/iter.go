@@ -0,0 +1,178 @@
+package btree
+
+import (
+	"errors"
+)
+
+// B+tree iterator. it keeps the path from the root to the current leaf,
+// so it can move across leaf boundaries in both directions.
+//
+// The position before the first key is the dummy key of the leftmost leaf,
+// the position after the last key is past the end of the rightmost leaf.
+// Both positions are not valid.
+type BIter struct {
+	tree *BTree
+	path []BNode  // from root to leaf
+	pos  []uint16 // indexes into nodes
+}
+
+// find the closest position that is less or equal to the input key
+func (tree *BTree) SeekLE(key []byte) (*BIter, error) {
+	iter := &BIter{tree: tree}
+	for ptr := tree.Root; ptr != 0; {
+		node := BNode(tree.Get(ptr))
+		idx, err := nodeLookupLE(node, key, tree.Compare)
+		if err != nil {
+			return nil, err
+		}
+		iter.path = append(iter.path, node)
+		iter.pos = append(iter.pos, idx)
+
+		switch node.btype() {
+		case BNODE_NODE:
+			if ptr, err = node.getPtr(idx); err != nil {
+				return nil, err
+			}
+		case BNODE_LEAF:
+			ptr = 0
+		default:
+			return nil, errors.New("bad node type")
+		}
+	}
+	return iter, nil
+}
+
+// find the closest position that is greater or equal to the input key
+func (tree *BTree) SeekGE(key []byte) (*BIter, error) {
+	iter, err := tree.SeekLE(key)
+	if err != nil {
+		return nil, err
+	}
+	if !iter.Valid() || tree.Compare(iter.Key(), key) < 0 {
+		if err = iter.Next(); err != nil {
+			return nil, err
+		}
+	}
+	return iter, nil
+}
+
+// is the iterator pointing to a key?
+func (iter *BIter) Valid() bool {
+	if len(iter.path) == 0 {
+		return false // empty tree
+	}
+	last := len(iter.path) - 1
+	if iter.pos[last] >= iter.path[last].nkeys() {
+		return false // past the last key
+	}
+	for _, idx := range iter.pos {
+		if idx != 0 {
+			return true
+		}
+	}
+	return false // the dummy key
+}
+
+// get the current KV pair. nil if the iterator is not valid.
+func (iter *BIter) Key() []byte {
+	if !iter.Valid() {
+		return nil
+	}
+	last := len(iter.path) - 1
+	key, err := iter.path[last].getKey(iter.pos[last])
+	if err != nil {
+		return nil
+	}
+	return key
+}
+
+// the value is reassembled if it's stored in overflow pages
+func (iter *BIter) Val() ([]byte, error) {
+	if !iter.Valid() {
+		return nil, nil
+	}
+	last := len(iter.path) - 1
+	return iter.tree.leafVal(iter.path[last], iter.pos[last])
+}
+
+// move forward. moving past the last key makes the iterator invalid.
+func (iter *BIter) Next() error {
+	if len(iter.path) == 0 {
+		return nil
+	}
+	last := len(iter.path) - 1
+	if iter.pos[last] >= iter.path[last].nkeys() {
+		return nil // already past the last key
+	}
+	moved, err := iterNext(iter, last)
+	if err != nil {
+		return err
+	}
+	if !moved {
+		iter.pos[last] = iter.path[last].nkeys() // past the last key
+	}
+	return nil
+}
+
+// move backward. moving before the first key makes the iterator invalid.
+func (iter *BIter) Prev() error {
+	if len(iter.path) == 0 {
+		return nil
+	}
+	last := len(iter.path) - 1
+	if iter.pos[last] >= iter.path[last].nkeys() {
+		iter.pos[last] = iter.path[last].nkeys() - 1 // back to the last key
+		return nil
+	}
+	_, err := iterPrev(iter, last)
+	return err
+}
+
+// move the position at the level forward. returns false at the end of the tree.
+func iterNext(iter *BIter, level int) (bool, error) {
+	if iter.pos[level]+1 < iter.path[level].nkeys() {
+		iter.pos[level]++ // move within this node
+	} else if level > 0 {
+		// move to a sibling node
+		if moved, err := iterNext(iter, level-1); err != nil || !moved {
+			return false, err
+		}
+	} else {
+		return false, nil // past the last key
+	}
+	if level+1 < len(iter.pos) {
+		// update the kid node
+		ptr, err := iter.path[level].getPtr(iter.pos[level])
+		if err != nil {
+			return false, err
+		}
+		iter.path[level+1] = iter.tree.Get(ptr)
+		iter.pos[level+1] = 0
+	}
+	return true, nil
+}
+
+// move the position at the level backward. returns false at the start of the tree.
+func iterPrev(iter *BIter, level int) (bool, error) {
+	if iter.pos[level] > 0 {
+		iter.pos[level]-- // move within this node
+	} else if level > 0 {
+		// move to a sibling node
+		if moved, err := iterPrev(iter, level-1); err != nil || !moved {
+			return false, err
+		}
+	} else {
+		return false, nil // the dummy key
+	}
+	if level+1 < len(iter.pos) {
+		// update the kid node
+		ptr, err := iter.path[level].getPtr(iter.pos[level])
+		if err != nil {
+			return false, err
+		}
+		kid := BNode(iter.tree.Get(ptr))
+		iter.path[level+1] = kid
+		iter.pos[level+1] = kid.nkeys() - 1
+	}
+	return true, nil
+}
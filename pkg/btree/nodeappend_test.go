@@ -28,12 +28,12 @@ func TestSuccessfullyAppendKVToNewNode(t *testing.T) {
 	}
 
 	if ptr != uint64(0) {
-		t.Fatal("unexpected ptr: %d", ptr)
+		t.Fatalf("unexpected ptr: %d", ptr)
 	}
 	if string(key) != "key_1" {
-		t.Fatal("unexpected key: %s", key)
+		t.Fatalf("unexpected key: %s", key)
 	}
 	if string(val) != "val_1" {
-		t.Fatal("unexpected value: %s", val)
+		t.Fatalf("unexpected value: %s", val)
 	}
 }
@@ -1,16 +1,16 @@
 package btree
 
 import (
-	"bytes"
 	"errors"
 )
 
 // returns the first kid node whose range intersects the key (kid[i] <= key).
 // (LE - Less-than-or-Equal)
-func nodeLookupLE(node BNode, key []byte) (uint16, error) {
+func nodeLookupLE(node BNode, key []byte, compare func(a, b []byte) int) (uint16, error) {
 	nkeys := node.nkeys()
 	found := uint16(0)
 
+	// binary search over the half-open range [startIdx, endIdx)
 	var nodeBinSearch func(startIdx, endIdx uint16) error
 	nodeBinSearch = func(startIdx, endIdx uint16) error {
 		if startIdx >= endIdx {
@@ -24,17 +24,17 @@ func nodeLookupLE(node BNode, key []byte) (uint16, error) {
 		}
 
 		// if key less or equal
-		if cmp := bytes.Compare(nodekey, key); cmp <= 0 {
+		if cmp := compare(nodekey, key); cmp <= 0 {
 			found = idx
 			return nodeBinSearch(idx+1, endIdx)
 		} else {
-			return nodeBinSearch(startIdx, idx-1)
+			return nodeBinSearch(startIdx, idx)
 		}
 	}
 
-	// the key by idx=0 is always 'nil' in internal node,
+	// the first key is a copy from the parent node (or the dummy key),
 	// thus it's always less than or equal to the key.
-	if err := nodeBinSearch(1, nkeys-1); err != nil {
+	if err := nodeBinSearch(1, nkeys); err != nil {
 		return 0, err
 	}
 
@@ -55,7 +55,7 @@ func nodeInsert(tree *BTree, new, old BNode, idx uint16, key, val []byte) error
 	}
 
 	// split the result
-	nsplit, split, err := nodeSplit3(kidNode)
+	nsplit, split, err := nodeSplit3(kidNode, tree.pageSize())
 	if err != nil {
 		return err
 	}
@@ -77,23 +77,22 @@ func nodeReplaceKidNode(tree *BTree, new, old BNode, idx uint16, kids ...BNode)
 	}
 
 	for i, node := range kids {
-		if i == 0 {
-			nodeAppendKV(new, idx+uint16(i), tree.New(node), nil, nil)
-		} else {
-			key, err := node.getKey(0)
-			if err != nil {
-				return err
-			}
-			if err = nodeAppendKV(new, idx+uint16(i), tree.New(node), key, nil); err != nil {
-				return err
-			}
+		// the separator key is a copy of the kid's first key
+		key, err := node.getKey(0)
+		if err != nil {
+			return err
+		}
+		if err = nodeAppendKV(new, idx+uint16(i), tree.New(node), key, nil); err != nil {
+			return err
 		}
 	}
 
 	return nodeAppendRange(new, old, idx+inc, idx+1, old.nkeys()-(idx+1))
 }
 
-// delete a key from an internal node; part of the treeDelete()
+// delete a key from an internal node; part of the treeDelete().
+// the new separator keys can be longer than the old ones, so the result
+// might be bigger than 1 page, like in nodeInsert().
 func nodeDelete(tree *BTree, node BNode, idx uint16, key []byte) (BNode, error) {
 	// recurse into the kid
 	kidptr, err := node.getPtr(idx)
@@ -112,7 +111,7 @@ func nodeDelete(tree *BTree, node BNode, idx uint16, key []byte) (BNode, error)
 
 	tree.Del(kidptr)
 
-	newNode := BNode(make([]byte, BTREE_PAGE_SIZE))
+	newNode := BNode(make([]byte, 2*tree.pageSize()))
 	// check for merging
 	mergeDir, sibling, err := tree.shouldMerge(node, idx, updated)
 	if err != nil {
@@ -121,7 +120,7 @@ func nodeDelete(tree *BTree, node BNode, idx uint16, key []byte) (BNode, error)
 
 	switch {
 	case mergeDir == SHOULD_MERGE_LEFT_SIBLING:
-		merged := BNode(make([]byte, BTREE_PAGE_SIZE))
+		merged := BNode(make([]byte, tree.pageSize()))
 
 		err = nodeMerge(merged, sibling, updated)
 		if err != nil {
@@ -144,7 +143,7 @@ func nodeDelete(tree *BTree, node BNode, idx uint16, key []byte) (BNode, error)
 			return BNode{}, err
 		}
 	case mergeDir == SHOULD_MERGE_RIGHT_SIBLING:
-		merged := BNode(make([]byte, BTREE_PAGE_SIZE))
+		merged := BNode(make([]byte, tree.pageSize()))
 
 		err = nodeMerge(merged, updated, sibling)
 		if err != nil {
@@ -172,7 +171,12 @@ func nodeDelete(tree *BTree, node BNode, idx uint16, key []byte) (BNode, error)
 		}
 		newNode.SetHeader(BNODE_NODE, 0) // the parent becomes empty too
 	case mergeDir == SHOULD_MERGE_NO && updated.nkeys() > 0: // no merge
-		err = nodeReplaceKidNode(tree, newNode, node, idx, updated)
+		// the kid is split if it has grown
+		nsplit, split, err := nodeSplit3(updated, tree.pageSize())
+		if err != nil {
+			return BNode{}, err
+		}
+		err = nodeReplaceKidNode(tree, newNode, node, idx, split[:nsplit]...)
 		if err != nil {
 			return BNode{}, err
 		}
@@ -180,78 +184,16 @@ func nodeDelete(tree *BTree, node BNode, idx uint16, key []byte) (BNode, error)
 	return newNode, nil
 }
 
-// merge 2 nodes into 1
+// merge 2 nodes into 1. all keys of the left node are less than
+// the keys of the right node, so it's a simple concatenation.
 func nodeMerge(new, left, right BNode) error {
-	var err error = nil
-
 	leftNKeys, rightNKeys := left.nkeys(), right.nkeys()
 	new.SetHeader(left.btype(), leftNKeys+rightNKeys)
 
-	leftIdx, rightIdx := uint16(0), uint16(0)
-
-	var iterations uint32 = 0
-	if leftNKeys > 0 {
-		iterations += uint32(leftNKeys - 1)
-	}
-	if rightNKeys > 0 {
-		iterations += uint32(rightNKeys - 1)
-	}
-
-	for i := uint32(0); i <= iterations; i++ {
-		leftKey, rightKey := []byte{}, []byte{}
-
-		if leftIdx < leftNKeys {
-			if leftKey, err = left.getKey(leftIdx); err != nil {
-				return err
-			}
-		}
-		if rightIdx < rightNKeys {
-			if rightKey, err = right.getKey(rightIdx); err != nil {
-				return err
-			}
-		}
-
-		cmp := bytes.Compare(leftKey, rightKey)
-		if cmp == 0 {
-			return errors.New("left and right nodes cant have equal keys")
-		}
-
-		if cmp < 0 && leftIdx != leftNKeys {
-			// leftKey < rightKey
-			ptr, err := left.getPtr(leftIdx)
-			if err != nil {
-				return err
-			}
-
-			val, err := left.getVal(leftIdx)
-			if err != nil {
-				return err
-			}
-
-			if err = nodeAppendKV(new, leftIdx, ptr, leftKey, val); err != nil {
-				return err
-			}
-			leftIdx++
-		} else {
-			// leftKey > rightKey
-			ptr, err := right.getPtr(rightIdx)
-			if err != nil {
-				return err
-			}
-
-			val, err := right.getVal(rightIdx)
-			if err != nil {
-				return err
-			}
-
-			if err = nodeAppendKV(new, rightIdx, ptr, rightKey, val); err != nil {
-				return err
-			}
-			rightIdx++
-		}
+	if err := nodeAppendRange(new, left, 0, 0, leftNKeys); err != nil {
+		return err
 	}
-
-	return nil
+	return nodeAppendRange(new, right, leftNKeys, 0, rightNKeys)
 }
 
 // replace 2 adjacent links with 1
@@ -1,14 +1,14 @@
 package btree
 
 // add a new key to a leaf node
-func leafInsert(new, old BNode, idx uint16, key, val []byte) error {
+func leafInsert(new, old BNode, idx uint16, ptr uint64, key, val []byte) error {
 	new.SetHeader(BNODE_LEAF, old.nkeys()+1) // setup the header
 	err := nodeAppendRange(new, old, 0, 0, idx)
 	if err != nil {
 		return err
 	}
 
-	err = nodeAppendKV(new, idx, 0, key, val)
+	err = nodeAppendKV(new, idx, ptr, key, val)
 	if err != nil {
 		return err
 	}
@@ -16,14 +16,14 @@ func leafInsert(new, old BNode, idx uint16, key, val []byte) error {
 	return nodeAppendRange(new, old, idx+1, idx, old.nkeys()-idx)
 }
 
-func leafUpdate(new, old BNode, idx uint16, key, val []byte) error {
+func leafUpdate(new, old BNode, idx uint16, ptr uint64, key, val []byte) error {
 	new.SetHeader(BNODE_LEAF, old.nkeys()) // setup the header
 	err := nodeAppendRange(new, old, 0, 0, idx)
 	if err != nil {
 		return err
 	}
 
-	err = nodeAppendKV(new, idx, 0, key, val)
+	err = nodeAppendKV(new, idx, ptr, key, val)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,137 @@
+package btree
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Overflow page format, a chain of pages holding a large value:
+// | type | size |  next  |  data  | unused |
+// |  2B  |  2B  |   8B   | size B |        |
+//
+// * type - BNODE_OVERFLOW
+// * size - number of value bytes in this page
+// * next - the next page of the chain, 0 for the last page
+//
+// A value larger than BTREE_MAX_VAL_SIZE is moved to overflow pages. The leaf
+// stores the first overflow page in the pointer of the KV (unused by leaves
+// otherwise) and the total length of the value as an 8-byte inline value.
+
+const BNODE_OVERFLOW = 3
+const OVERFLOW_HEADER = 12
+const BTREE_MAX_OVERFLOW_SIZE = 1 << 28 // the largest value
+
+// the value bytes in an overflow page
+func overflowCap(pageSize int) int {
+	return PageCap(pageSize) - OVERFLOW_HEADER
+}
+
+// the stored form of a leaf value: either inline or a pointer to overflow pages
+func (tree *BTree) leafStore(val []byte) (uint64, []byte) {
+	if len(val) <= BTREE_MAX_VAL_SIZE {
+		return 0, val
+	}
+	size := make([]byte, 8)
+	binary.LittleEndian.PutUint64(size, uint64(len(val)))
+	return tree.overflowWrite(val), size
+}
+
+// the value of a leaf KV, reassembled from overflow pages if needed
+func (tree *BTree) leafVal(node BNode, idx uint16) ([]byte, error) {
+	val, err := node.getVal(idx)
+	if err != nil {
+		return nil, err
+	}
+	ptr, err := node.getPtr(idx)
+	if err != nil {
+		return nil, err
+	}
+	if ptr == 0 {
+		return val, nil // inline
+	}
+	if len(val) != 8 {
+		return nil, errors.New("bad overflow value")
+	}
+	return tree.overflowRead(ptr, binary.LittleEndian.Uint64(val))
+}
+
+// free the overflow pages of a leaf KV, if any
+func (tree *BTree) leafFree(node BNode, idx uint16) error {
+	ptr, err := node.getPtr(idx)
+	if err != nil || ptr == 0 {
+		return err
+	}
+	for ptr != 0 {
+		page, err := overflowPage(tree.Get(ptr), ptr)
+		if err != nil {
+			return err
+		}
+		tree.Del(ptr)
+		ptr = page.next
+	}
+	return nil
+}
+
+// write a large value to a chain of overflow pages. returns the first page.
+func (tree *BTree) overflowWrite(val []byte) uint64 {
+	// from the tail, so every page knows the next one
+	ocap := overflowCap(tree.pageSize())
+	next := uint64(0)
+	for i := (len(val) - 1) / ocap; i >= 0; i-- {
+		chunk := val[i*ocap:]
+		if len(chunk) > ocap {
+			chunk = chunk[:ocap]
+		}
+		page := make([]byte, tree.pageSize())
+		binary.LittleEndian.PutUint16(page[0:], BNODE_OVERFLOW)
+		binary.LittleEndian.PutUint16(page[2:], uint16(len(chunk)))
+		binary.LittleEndian.PutUint64(page[4:], next)
+		copy(page[OVERFLOW_HEADER:], chunk)
+		next = tree.New(page)
+	}
+	return next
+}
+
+// read a value of `size` bytes from a chain of overflow pages
+func (tree *BTree) overflowRead(ptr uint64, size uint64) ([]byte, error) {
+	if size > BTREE_MAX_OVERFLOW_SIZE {
+		return nil, fmt.Errorf("bad overflow value size %d", size)
+	}
+	val := make([]byte, 0, size)
+	for ptr != 0 {
+		page, err := overflowPage(tree.Get(ptr), ptr)
+		if err != nil {
+			return nil, err
+		}
+		if uint64(len(val)+len(page.data)) > size {
+			return nil, fmt.Errorf("page %d: the overflow chain is too long", ptr)
+		}
+		val = append(val, page.data...)
+		ptr = page.next
+	}
+	if uint64(len(val)) != size {
+		return nil, errors.New("the overflow chain is too short")
+	}
+	return val, nil
+}
+
+// a decoded overflow page
+type overflow struct {
+	next uint64
+	data []byte
+}
+
+func overflowPage(page []byte, ptr uint64) (overflow, error) {
+	if t := binary.LittleEndian.Uint16(page[0:]); t != BNODE_OVERFLOW {
+		return overflow{}, fmt.Errorf("page %d: bad overflow page type %d", ptr, t)
+	}
+	size := binary.LittleEndian.Uint16(page[2:])
+	if size == 0 || int(size) > overflowCap(len(page)) {
+		return overflow{}, fmt.Errorf("page %d: bad overflow page size %d", ptr, size)
+	}
+	return overflow{
+		next: binary.LittleEndian.Uint64(page[4:]),
+		data: page[OVERFLOW_HEADER:][:size],
+	}, nil
+}
@@ -4,22 +4,23 @@ import (
 	"errors"
 )
 
-// split a node if it's too big. the results are 1~3 nodes.
-func nodeSplit3(old BNode) (uint16, [3]BNode, error) {
+// split a node if it's too big. the results are 1~3 nodes of `pageSize` bytes.
+func nodeSplit3(old BNode, pageSize int) (uint16, [3]BNode, error) {
+	pageCap := PageCap(pageSize)
 	oldNbytes, err := old.NBytes()
 	if err != nil {
 		return 0, [3]BNode{}, err
 	}
 
-	if oldNbytes <= BTREE_PAGE_SIZE {
-		old = old[:BTREE_PAGE_SIZE]
+	if int(oldNbytes) <= pageCap {
+		old = old[:pageSize]
 		return 1, [3]BNode{old}, nil // no split
 	}
 
 	// split on 2 nodes
-	left := BNode(make([]byte, 2*BTREE_PAGE_SIZE)) // maybe split later
-	right := BNode(make([]byte, BTREE_PAGE_SIZE))
-	if err := nodeSplit2(left, right, old); err != nil {
+	left := BNode(make([]byte, 2*pageSize)) // maybe split later
+	right := BNode(make([]byte, pageSize))
+	if err := nodeSplit2(left, right, old, pageCap); err != nil {
 		return 0, [3]BNode{}, err
 	}
 
@@ -27,14 +28,15 @@ func nodeSplit3(old BNode) (uint16, [3]BNode, error) {
 	if err != nil {
 		return 0, [3]BNode{}, err
 	}
-	if leftNbytes <= BTREE_PAGE_SIZE {
+	if int(leftNbytes) <= pageCap {
+		left = left[:pageSize]
 		return 2, [3]BNode{left, right}, nil
 	}
 
 	// split on 3 nodes
-	leftleft := BNode(make([]byte, BTREE_PAGE_SIZE))
-	middle := BNode(make([]byte, BTREE_PAGE_SIZE))
-	if err := nodeSplit2(leftleft, middle, left); err != nil {
+	leftleft := BNode(make([]byte, pageSize))
+	middle := BNode(make([]byte, pageSize))
+	if err := nodeSplit2(leftleft, middle, left, pageCap); err != nil {
 		return 0, [3]BNode{}, err
 	}
 
@@ -42,8 +44,8 @@ func nodeSplit3(old BNode) (uint16, [3]BNode, error) {
 	if err != nil {
 		return 0, [3]BNode{}, err
 	}
-	if llNbytes > BTREE_PAGE_SIZE {
-		return 0, [3]BNode{}, errors.New("llNbytes > BTREE_PAGE_SIZE")
+	if int(llNbytes) > pageCap {
+		return 0, [3]BNode{}, errors.New("llNbytes > pageCap")
 	}
 
 	return 3, [3]BNode{leftleft, middle, right}, nil // 3 nodes
@@ -51,24 +53,26 @@ func nodeSplit3(old BNode) (uint16, [3]BNode, error) {
 
 // internal
 // split a oversized node into 2 so that the 2nd node always fits on a page.
-func nodeSplit2(left, right, old BNode) error {
+func nodeSplit2(left, right, old BNode, pageCap int) error {
 	var err error
 
 	nkeys := old.nkeys()
 
-	currBytes := uint32(0)
-	delimeter := uint16(0)
-	for i := nkeys - 1; i != 0; i-- {
-		kvlen, err := old.kvBytes(i)
+	// move KVs to the right node while it still fits on a page;
+	// each KV also takes a pointer and an offset.
+	currBytes := uint32(HEADER)
+	delimeter := nkeys
+	for delimeter > 1 {
+		kvlen, err := old.kvBytes(delimeter - 1)
 		if err != nil {
 			return err
 		}
 
-		if currBytes+kvlen > BTREE_PAGE_SIZE {
-			delimeter = i + 1
+		if int(currBytes+8+2+kvlen) > pageCap {
 			break
 		}
-		currBytes += kvlen
+		currBytes += 8 + 2 + kvlen
+		delimeter--
 	}
 
 	left.SetHeader(old.btype(), delimeter)
@@ -0,0 +1,76 @@
+package btree
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/vansilich/db/pkg/btree"
+	"github.com/vansilich/db/pkg/btree/tests/utils"
+)
+
+func TestBatchUpdate(t *testing.T) {
+	c := utils.NewC()
+	r := rand.New(rand.NewSource(1))
+	for round := 0; round < 200; round++ {
+		// a batch of sorted unique keys
+		n := 1 + r.Intn(500)
+		if round%50 == 0 {
+			n = 5000
+		}
+		keys := map[string]bool{}
+		for len(keys) < n {
+			keys[fmt.Sprintf("key_%05d", r.Intn(20000))] = true
+		}
+		ops := make([]btree.Op, 0, n)
+		for key := range keys {
+			op := btree.Op{Key: []byte(key)}
+			switch x := r.Intn(10); {
+			case x < 4 || round > 150:
+				op.Del = true
+			case x == 4:
+				op.Val = []byte(strings.Repeat(key, 500)) // overflow pages
+			default:
+				op.Val = []byte(fmt.Sprintf("val_%d_%d", round, r.Intn(1000)))
+			}
+			ops = append(ops, op)
+		}
+		sort.Slice(ops, func(i, j int) bool { return string(ops[i].Key) < string(ops[j].Key) })
+
+		if err := c.Tree.Update(ops); err != nil {
+			t.Fatalf("[%d] Tree.Update() has error: %s", round, err.Error())
+		}
+		for _, op := range ops {
+			if op.Del {
+				delete(c.Ref, string(op.Key))
+			} else {
+				c.Ref[string(op.Key)] = string(op.Val)
+			}
+		}
+
+		stats, violations := c.Tree.Check(func(uint64) error { return nil })
+		if len(violations) != 0 {
+			t.Fatalf("[%d] Tree.Check() = %v", round, violations)
+		}
+		if stats.Keys != uint64(len(c.Ref)) {
+			t.Fatalf("[%d] unexpected number of keys: %d, want %d", round, stats.Keys, len(c.Ref))
+		}
+		if uint64(len(c.Pages)) != stats.Nodes+stats.Leaves+stats.Overflow {
+			t.Fatalf("[%d] %d pages are not deallocated", round, uint64(len(c.Pages))-stats.Nodes-stats.Leaves-stats.Overflow)
+		}
+	}
+	for key, ref := range c.Ref {
+		val, found, err := c.Tree.Lookup([]byte(key))
+		if err != nil || !found || string(val) != ref {
+			t.Fatalf("Tree.Lookup(%q) = %q, %v, %v", key, val, found, err)
+		}
+	}
+
+	// the ops must be sorted
+	ops := []btree.Op{{Key: []byte("b")}, {Key: []byte("a")}}
+	if err := c.Tree.Update(ops); err == nil {
+		t.Fatalf("Tree.Update() accepted unsorted ops")
+	}
+}
@@ -0,0 +1,51 @@
+package btree
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/vansilich/db/pkg/btree"
+	"github.com/vansilich/db/pkg/btree/tests/utils"
+)
+
+func TestBulkLoad(t *testing.T) {
+	for _, fill := range []float64{0.5, btree.BTREE_BULK_FILL, 1} {
+		c := utils.NewC()
+		if err := c.Add("old", "old"); err != nil {
+			t.Fatalf("Tree.Insert() has error: %s", err.Error())
+		}
+		b, err := c.Tree.BulkLoad(fill)
+		if err != nil {
+			t.Fatalf("Tree.BulkLoad() has error: %s", err.Error())
+		}
+		for i := 0; i < 10000; i++ {
+			key, val := fmt.Sprintf("key_%05d", i), fmt.Sprintf("val_%d", i)
+			if err = b.Add([]byte(key), []byte(val)); err != nil {
+				t.Fatalf("[%d] BulkLoader.Add() has error: %s", i, err.Error())
+			}
+		}
+		if err = b.Add([]byte("key_00000"), nil); err == nil {
+			t.Fatalf("BulkLoader.Add() accepted a duplicate key")
+		}
+		if err = b.Finish(); err != nil {
+			t.Fatalf("BulkLoader.Finish() has error: %s", err.Error())
+		}
+
+		stats, violations := c.Tree.Check(func(uint64) error { return nil })
+		if len(violations) != 0 {
+			t.Fatalf("Tree.Check() = %v", violations)
+		}
+		if stats.Keys != 10000 {
+			t.Fatalf("unexpected number of keys: %d", stats.Keys)
+		}
+		if uint64(len(c.Pages)) != stats.Nodes+stats.Leaves {
+			t.Fatalf("the old tree is not deallocated: %d pages", len(c.Pages))
+		}
+		for _, i := range []int{0, 1, 5000, 9999} {
+			val, found, err := c.Tree.Lookup([]byte(fmt.Sprintf("key_%05d", i)))
+			if err != nil || !found || string(val) != fmt.Sprintf("val_%d", i) {
+				t.Fatalf("Tree.Lookup(%d) = %q, %v, %v", i, val, found, err)
+			}
+		}
+	}
+}
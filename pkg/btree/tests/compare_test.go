@@ -0,0 +1,62 @@
+package btree
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/vansilich/db/pkg/btree"
+	"github.com/vansilich/db/pkg/btree/tests/utils"
+)
+
+func TestReverseComparator(t *testing.T) {
+	c := utils.NewC()
+	c.Tree.Cmp = btree.Reverse
+	for i := 0; i < 2000; i++ {
+		if err := c.Add(fmt.Sprintf("key_%04d", i), fmt.Sprintf("val_%d", i)); err != nil {
+			t.Fatalf("[%d] Tree.Insert() has error: %s", i, err.Error())
+		}
+	}
+	for i := 0; i < 2000; i += 2 {
+		if _, err := c.Del(fmt.Sprintf("key_%04d", i)); err != nil {
+			t.Fatalf("[%d] Tree.Delete() has error: %s", i, err.Error())
+		}
+	}
+	if _, violations := c.Tree.Check(func(uint64) error { return nil }); len(violations) != 0 {
+		t.Fatalf("Tree.Check() = %v", violations)
+	}
+
+	// the keys are in the descending order
+	iter, err := c.Tree.SeekGE(nil)
+	if err != nil {
+		t.Fatalf("Tree.SeekGE() has error: %s", err.Error())
+	}
+	for i := 1999; i > 0; i -= 2 {
+		if key := fmt.Sprintf("key_%04d", i); !iter.Valid() || string(iter.Key()) != key {
+			t.Fatalf("unexpected key: %q, want %q", iter.Key(), key)
+		}
+		if err = iter.Next(); err != nil {
+			t.Fatalf("BIter.Next() has error: %s", err.Error())
+		}
+	}
+	if iter.Valid() {
+		t.Fatalf("the iterator is valid past the last key")
+	}
+}
+
+func TestCaseInsensitiveComparator(t *testing.T) {
+	c := utils.NewC()
+	c.Tree.Cmp = btree.CaseInsensitive
+	if err := c.Add("Key", "1"); err != nil {
+		t.Fatalf("Tree.Insert() has error: %s", err.Error())
+	}
+	if err := c.Add("KEY", "2"); err != nil {
+		t.Fatalf("Tree.Insert() has error: %s", err.Error())
+	}
+	val, found, err := c.Tree.Lookup([]byte("key"))
+	if err != nil || !found || string(val) != "2" {
+		t.Fatalf("Tree.Lookup() = %q, %v, %v", val, found, err)
+	}
+	if deleted, err := c.Tree.Delete([]byte("kEy")); err != nil || !deleted {
+		t.Fatalf("Tree.Delete() = %v, %v", deleted, err)
+	}
+}
@@ -0,0 +1,90 @@
+package btree
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/vansilich/db/pkg/btree"
+	"github.com/vansilich/db/pkg/btree/tests/utils"
+)
+
+func TestCopy(t *testing.T) {
+	c := utils.NewC()
+	large := strings.Repeat("x", 10000)
+	for i := 0; i < 5000; i++ {
+		val := fmt.Sprintf("val_%d", i)
+		if i%500 == 0 {
+			val = large
+		}
+		if err := c.Add(fmt.Sprintf("key_%05d", i), val); err != nil {
+			t.Fatalf("Tree.Insert() has error: %s", err.Error())
+		}
+	}
+
+	const base = 10
+	cp, err := c.Tree.Copy(base)
+	if err != nil {
+		t.Fatalf("Tree.Copy() has error: %s", err.Error())
+	}
+	if cp.Pages() != len(c.Pages) || cp.Root() != base {
+		t.Fatalf("the copy has %d pages from %d, the tree %d pages", cp.Pages(), cp.Root(), len(c.Pages))
+	}
+	pages := map[uint64][]byte{}
+	next := uint64(base)
+	err = cp.Write(func(page []byte) error {
+		pages[next] = page
+		next++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("TreeCopy.Write() has error: %s", err.Error())
+	}
+
+	copied := btree.BTree{
+		Root: cp.Root(),
+		Get: func(ptr uint64) []byte {
+			page, ok := pages[ptr]
+			if !ok {
+				panic("BTree.Get: undefined page ptr")
+			}
+			return page
+		},
+	}
+	stats, violations := copied.Check(func(uint64) error { return nil })
+	if len(violations) != 0 {
+		t.Fatalf("Tree.Check() = %v", violations)
+	}
+	if stats.Keys != 5000 || stats.Overflow == 0 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	for key, want := range c.Ref {
+		val, found, err := copied.Lookup([]byte(key))
+		if err != nil || !found || string(val) != want {
+			t.Fatalf("Tree.Lookup(%q) = %d bytes, %v, %v", key, len(val), found, err)
+		}
+	}
+
+	// leaves are in key order
+	prev := uint64(0)
+	for ptr := uint64(base); ptr < next; ptr++ {
+		dump, err := btree.DumpNode(pages[ptr])
+		if err != nil || dump.Type != btree.BNODE_LEAF {
+			continue
+		}
+		if prev != 0 {
+			last := pages[prev]
+			lastDump, _ := btree.DumpNode(last)
+			if string(lastDump.Keys[len(lastDump.Keys)-1]) >= string(dump.Keys[0]) {
+				t.Fatalf("leaf %d is not after leaf %d", ptr, prev)
+			}
+		}
+		prev = ptr
+	}
+
+	// an empty tree
+	cp, err = (&btree.BTree{}).Copy(base)
+	if err != nil || cp.Pages() != 0 || cp.Root() != 0 {
+		t.Fatalf("Tree.Copy() of an empty tree = %v, %v", cp, err)
+	}
+}
@@ -0,0 +1,104 @@
+package btree
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/vansilich/db/pkg/btree/tests/utils"
+)
+
+func TestDeleteNotFound(t *testing.T) {
+	c := utils.NewC()
+	deleted, err := c.Del("test_key")
+	if err != nil {
+		t.Fatalf("Tree.Delete() has error: %s", err.Error())
+	}
+	if deleted {
+		t.Fatalf("Tree.Delete() deleted a key from the empty tree")
+	}
+
+	if err = c.Add("test_key", "test_value"); err != nil {
+		t.Fatalf("Tree.Insert() has error: %s", err.Error())
+	}
+	if deleted, _ = c.Del("missing_key"); deleted {
+		t.Fatalf("Tree.Delete() deleted a missing key")
+	}
+	if len(c.Pages) != 1 {
+		t.Fatalf("unexpected number of pages: %d", len(c.Pages))
+	}
+}
+
+func TestDeleteAll(t *testing.T) {
+	c := utils.NewC()
+	n := 2000
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("test_key_%d", i)
+		val := fmt.Sprintf("test_value_%d_%0100d", i, i)
+		if err := c.Add(key, val); err != nil {
+			t.Fatalf("[%d] Tree.Insert() has error: %s", i, err.Error())
+		}
+	}
+
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("test_key_%d", (i*7919)%n)
+		deleted, err := c.Del(key)
+		if err != nil {
+			t.Fatalf("Tree.Delete(%q) has error: %s", key, err.Error())
+		}
+		if !deleted {
+			t.Fatalf("Tree.Delete(%q): not found", key)
+		}
+		if _, found, _ := c.Tree.Lookup([]byte(key)); found {
+			t.Fatalf("Tree.Lookup(%q) found a deleted key", key)
+		}
+
+		// the remaining keys are still reachable
+		if i%100 == 0 {
+			for ref, val := range c.Ref {
+				got, found, err := c.Tree.Lookup([]byte(ref))
+				if err != nil || !found || string(got) != val {
+					t.Fatalf("Tree.Lookup(%q) = %q, %v, %v", ref, got, found, err)
+				}
+			}
+		}
+	}
+
+	// only the root leaf with the dummy key is left
+	if len(c.Pages) != 1 {
+		t.Fatalf("unexpected number of pages: %d", len(c.Pages))
+	}
+}
+
+func TestDeleteLongSeparators(t *testing.T) {
+	c := utils.NewC()
+	// a short key before every long one, the leaves start with short keys
+	long := func(i int) string {
+		return fmt.Sprintf("k%04d_%0900d", i, i)
+	}
+	n := 400
+	for i := 0; i < n; i++ {
+		if err := c.Add(fmt.Sprintf("k%04d", i), "v"); err != nil {
+			t.Fatalf("Tree.Insert() has error: %s", err.Error())
+		}
+		if err := c.Add(long(i), "v"); err != nil {
+			t.Fatalf("Tree.Insert() has error: %s", err.Error())
+		}
+	}
+
+	// the separators become long, the parents are split
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("k%04d", i)
+		deleted, err := c.Del(key)
+		if err != nil || !deleted {
+			t.Fatalf("Tree.Delete(%q) = %v, %v", key, deleted, err)
+		}
+	}
+	for i := 0; i < n; i++ {
+		if _, found, err := c.Tree.Lookup([]byte(long(i))); err != nil || !found {
+			t.Fatalf("Tree.Lookup(%q) = %v, %v", long(i), found, err)
+		}
+	}
+	if _, violations := c.Tree.Check(func(uint64) error { return nil }); len(violations) != 0 {
+		t.Fatalf("Tree.Check() = %v", violations)
+	}
+}
@@ -1,8 +1,10 @@
 package btree
 
 import (
+	"fmt"
 	"testing"
 
+	"github.com/vansilich/db/pkg/btree"
 	"github.com/vansilich/db/pkg/btree/tests/utils"
 )
 
@@ -24,3 +26,25 @@ func TestInsertTwo(t *testing.T) {
 		t.Fatalf("[2] Tree.Insert() has error: %s", err.Error())
 	}
 }
+
+func TestInsertPageSize(t *testing.T) {
+	c := utils.NewC()
+	c.Tree.PageSize = btree.BTREE_MAX_PAGE_SIZE
+	for i := 0; i < 5000; i++ {
+		if err := c.Add(fmt.Sprintf("key_%d", i), fmt.Sprintf("val_%0100d", i)); err != nil {
+			t.Fatalf("[%d] Tree.Insert() has error: %s", i, err.Error())
+		}
+	}
+	stats, violations := c.Tree.Check(func(uint64) error { return nil })
+	if len(violations) != 0 {
+		t.Fatalf("Tree.Check() = %v", violations)
+	}
+	if stats.Keys != 5000 {
+		t.Fatalf("unexpected number of keys: %d", stats.Keys)
+	}
+	for ptr, page := range c.Pages {
+		if len(page) != btree.BTREE_MAX_PAGE_SIZE {
+			t.Fatalf("page %d has %d bytes", ptr, len(page))
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package btree
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/vansilich/db/pkg/btree/tests/utils"
+)
+
+func TestIterEmpty(t *testing.T) {
+	c := utils.NewC()
+	iter, err := c.Tree.SeekGE([]byte("test_key"))
+	if err != nil {
+		t.Fatalf("Tree.SeekGE() has error: %s", err.Error())
+	}
+	if iter.Valid() {
+		t.Fatalf("the iterator is valid in the empty tree")
+	}
+}
+
+func TestIterScan(t *testing.T) {
+	c := utils.NewC()
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("test_key_%04d", (i*7919)%2000)
+		if err := c.Add(key, fmt.Sprintf("test_value_%0100d", i)); err != nil {
+			t.Fatalf("[%d] Tree.Insert() has error: %s", i, err.Error())
+		}
+	}
+	keys := make([]string, 0, len(c.Ref))
+	for key := range c.Ref {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	// forward from the start
+	iter, err := c.Tree.SeekGE(nil)
+	if err != nil {
+		t.Fatalf("Tree.SeekGE() has error: %s", err.Error())
+	}
+	for i, key := range keys {
+		val, err := iter.Val()
+		if err != nil {
+			t.Fatalf("BIter.Val() has error: %s", err.Error())
+		}
+		if !iter.Valid() || string(iter.Key()) != key || string(val) != c.Ref[key] {
+			t.Fatalf("[%d] unexpected key: %q, want %q", i, iter.Key(), key)
+		}
+		if err = iter.Next(); err != nil {
+			t.Fatalf("BIter.Next() has error: %s", err.Error())
+		}
+	}
+	if iter.Valid() {
+		t.Fatalf("the iterator is valid past the last key")
+	}
+
+	// backward from the end
+	for i := len(keys) - 1; i >= 0; i-- {
+		if err = iter.Prev(); err != nil {
+			t.Fatalf("BIter.Prev() has error: %s", err.Error())
+		}
+		if !iter.Valid() || string(iter.Key()) != keys[i] {
+			t.Fatalf("[%d] unexpected key: %q, want %q", i, iter.Key(), keys[i])
+		}
+	}
+	if err = iter.Prev(); err != nil {
+		t.Fatalf("BIter.Prev() has error: %s", err.Error())
+	}
+	if iter.Valid() {
+		t.Fatalf("the iterator is valid before the first key")
+	}
+}
+
+func TestIterSeek(t *testing.T) {
+	c := utils.NewC()
+	for i := 0; i < 1000; i += 2 {
+		if err := c.Add(fmt.Sprintf("test_key_%04d", i), "test_value"); err != nil {
+			t.Fatalf("[%d] Tree.Insert() has error: %s", i, err.Error())
+		}
+	}
+
+	for i := 1; i < 998; i += 2 {
+		key := []byte(fmt.Sprintf("test_key_%04d", i))
+		le, err := c.Tree.SeekLE(key)
+		if err != nil {
+			t.Fatalf("Tree.SeekLE() has error: %s", err.Error())
+		}
+		if want := fmt.Sprintf("test_key_%04d", i-1); string(le.Key()) != want {
+			t.Fatalf("Tree.SeekLE(%q) = %q, want %q", key, le.Key(), want)
+		}
+		ge, err := c.Tree.SeekGE(key)
+		if err != nil {
+			t.Fatalf("Tree.SeekGE() has error: %s", err.Error())
+		}
+		if want := fmt.Sprintf("test_key_%04d", i+1); string(ge.Key()) != want {
+			t.Fatalf("Tree.SeekGE(%q) = %q, want %q", key, ge.Key(), want)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package btree
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/vansilich/db/pkg/btree/tests/utils"
+)
+
+func TestLookupEmpty(t *testing.T) {
+	c := utils.NewC()
+	_, found, err := c.Tree.Lookup([]byte("test_key"))
+	if err != nil {
+		t.Fatalf("Tree.Lookup() has error: %s", err.Error())
+	}
+	if found {
+		t.Fatalf("Tree.Lookup() found a key in the empty tree")
+	}
+}
+
+func TestLookupMany(t *testing.T) {
+	c := utils.NewC()
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("test_key_%d", (i*7919)%2000)
+		val := fmt.Sprintf("test_value_%d_%0100d", i, i)
+		if err := c.Add(key, val); err != nil {
+			t.Fatalf("[%d] Tree.Insert() has error: %s", i, err.Error())
+		}
+	}
+
+	for key, val := range c.Ref {
+		got, found, err := c.Tree.Lookup([]byte(key))
+		if err != nil {
+			t.Fatalf("Tree.Lookup(%q) has error: %s", key, err.Error())
+		}
+		if !found {
+			t.Fatalf("Tree.Lookup(%q): not found", key)
+		}
+		if string(got) != val {
+			t.Fatalf("Tree.Lookup(%q) = %q, want %q", key, got, val)
+		}
+	}
+
+	if _, found, _ := c.Tree.Lookup([]byte("missing_key")); found {
+		t.Fatalf("Tree.Lookup() found a missing key")
+	}
+}
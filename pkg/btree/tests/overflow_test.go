@@ -0,0 +1,46 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/vansilich/db/pkg/btree"
+	"github.com/vansilich/db/pkg/btree/tests/utils"
+)
+
+func TestOverflowValues(t *testing.T) {
+	c := utils.NewC()
+	sizes := []int{btree.BTREE_MAX_VAL_SIZE, btree.BTREE_MAX_VAL_SIZE + 1, (btree.PageCap(btree.BTREE_PAGE_SIZE) - btree.OVERFLOW_HEADER) * 3, 50000}
+	for i, size := range sizes {
+		val := bytes.Repeat([]byte{byte('a' + i)}, size)
+		if err := c.Add(fmt.Sprintf("key_%d", i), string(val)); err != nil {
+			t.Fatalf("[%d] Tree.Insert() has error: %s", i, err.Error())
+		}
+	}
+	for key, ref := range c.Ref {
+		val, found, err := c.Tree.Lookup([]byte(key))
+		if err != nil || !found || string(val) != ref {
+			t.Fatalf("Tree.Lookup(%q) = %d bytes, %v, %v", key, len(val), found, err)
+		}
+	}
+	if _, violations := c.Tree.Check(func(uint64) error { return nil }); len(violations) != 0 {
+		t.Fatalf("Tree.Check() = %v", violations)
+	}
+
+	// updating and deleting large values frees their overflow pages
+	if err := c.Add("key_3", "small"); err != nil {
+		t.Fatalf("Tree.Insert() has error: %s", err.Error())
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := c.Del(fmt.Sprintf("key_%d", i)); err != nil {
+			t.Fatalf("Tree.Delete() has error: %s", err.Error())
+		}
+	}
+	if len(c.Pages) != 1 {
+		t.Fatalf("unexpected number of pages: %d", len(c.Pages))
+	}
+	if val, _, _ := c.Tree.Lookup([]byte("key_3")); string(val) != "small" {
+		t.Fatalf("Tree.Lookup() = %q", val)
+	}
+}
@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"encoding/binary"
 	"unsafe"
 
 	"github.com/vansilich/db/pkg/btree"
@@ -24,12 +25,14 @@ func NewC() *C {
 				return page
 			},
 			New: func(node []byte) uint64 {
-				nbytes, err := btree.BNode(node).NBytes()
-				if err != nil {
-					panic(err)
-				}
-				if nbytes > btree.BTREE_PAGE_SIZE {
-					panic("BTree.New: nbytes > btree.BTREE_PAGE_SIZE")
+				if binary.LittleEndian.Uint16(node) != btree.BNODE_OVERFLOW {
+					nbytes, err := btree.BNode(node).NBytes()
+					if err != nil {
+						panic(err)
+					}
+					if int(nbytes) > btree.PageCap(len(node)) {
+						panic("BTree.New: the node does not fit on a page")
+					}
 				}
 				ptr := uint64(uintptr(unsafe.Pointer(&node[0])))
 				if !(pages[ptr] == nil) {
@@ -58,3 +61,12 @@ func (c *C) Add(key string, val string) error {
 	c.Ref[key] = val // reference data
 	return nil
 }
+
+func (c *C) Del(key string) (bool, error) {
+	deleted, err := c.Tree.Delete([]byte(key))
+	if err != nil {
+		return false, err
+	}
+	delete(c.Ref, key) // reference data
+	return deleted, nil
+}
@@ -1,17 +1,29 @@
 package freelist
 
-import "github.com/vansilich/db/pkg/btree"
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/vansilich/db/pkg/btree"
+)
 
 type LNode []byte
 
 const FREE_LIST_HEADER = 8
-const FREE_LIST_CAP = (btree.BTREE_PAGE_SIZE - FREE_LIST_HEADER) / 8
+const FREE_LIST_ITEM = 16 // pointer + version
+
+// number of items in a list node
+func nodeCap(pageSize int) int {
+	return (btree.PageCap(pageSize) - FREE_LIST_HEADER) / FREE_LIST_ITEM
+}
 
 type FreeList struct {
 	// callbacks for managing on-disk pages
 	Get func(uint64) []byte // read a page
 	New func([]byte) uint64 // append a new page
 	Set func(uint64) []byte // update an existing page
+	// page size in bytes, 0 means btree.BTREE_PAGE_SIZE
+	PageSize int
 	// persisted data in the meta page
 	headPage uint64 // pointer to the list head node
 	headSeq  uint64 // monotonic sequence number to index into the list head
@@ -19,22 +31,109 @@ type FreeList struct {
 	tailSeq  uint64
 	// in-memory states
 	maxSeq uint64 // saved `tailSeq` to prevent consuming newly added items
+	maxVer uint64 // the oldest version visible to readers
+	curVer uint64 // the version of the current update
+}
+
+// the list state persisted in the meta page
+type Meta struct {
+	HeadPage uint64
+	HeadSeq  uint64
+	TailPage uint64
+	TailSeq  uint64
 }
 
 // getters & setters
-func (node LNode) getNext() uint64
-func (node LNode) setNext(next uint64)
-func (node LNode) getPtr(idx int) uint64
-func (node LNode) setPtr(idx int, ptr uint64)
+func (node LNode) getNext() uint64 {
+	return binary.LittleEndian.Uint64(node[0:8])
+}
+
+func (node LNode) setNext(next uint64) {
+	binary.LittleEndian.PutUint64(node[0:8], next)
+}
+
+func (node LNode) getItem(idx int) (ptr uint64, ver uint64) {
+	pos := FREE_LIST_HEADER + FREE_LIST_ITEM*idx
+	ptr = binary.LittleEndian.Uint64(node[pos:])
+	ver = binary.LittleEndian.Uint64(node[pos+8:])
+	return
+}
+
+func (node LNode) setItem(idx int, ptr uint64, ver uint64) {
+	pos := FREE_LIST_HEADER + FREE_LIST_ITEM*idx
+	binary.LittleEndian.PutUint64(node[pos:], ptr)
+	binary.LittleEndian.PutUint64(node[pos+8:], ver)
+}
+
+func (fl *FreeList) SaveMeta() Meta {
+	return Meta{
+		HeadPage: fl.headPage,
+		HeadSeq:  fl.headSeq,
+		TailPage: fl.tailPage,
+		TailSeq:  fl.tailSeq,
+	}
+}
+
+// restore the persisted state; all the items are available for consumption
+func (fl *FreeList) LoadMeta(meta Meta) {
+	fl.headPage, fl.headSeq = meta.HeadPage, meta.HeadSeq
+	fl.tailPage, fl.tailSeq = meta.TailPage, meta.TailSeq
+	fl.maxSeq = fl.tailSeq
+}
+
+// roll back to a saved state after a failed or aborted update. unlike
+// `LoadMeta`, the items added since the last `SetMaxSeq` stay unavailable.
+func (fl *FreeList) Revert(meta Meta) {
+	maxSeq := fl.maxSeq
+	if maxSeq > meta.TailSeq {
+		maxSeq = meta.TailSeq
+	}
+	fl.LoadMeta(meta)
+	fl.maxSeq = maxSeq
+}
 
 // get 1 item from the list head. return 0 on failure.
-func (fl *FreeList) PopHead() uint64
+func (fl *FreeList) PopHead() uint64 {
+	ptr, head := flPop(fl)
+	if head != 0 { // the empty head node is recycled
+		fl.PushTail(head)
+	}
+	return ptr
+}
 
 // add 1 item to the tail
-func (fl *FreeList) PushTail(ptr uint64)
+func (fl *FreeList) PushTail(ptr uint64) {
+	// add it to the tail node
+	LNode(fl.Set(fl.tailPage)).setItem(fl.seq2idx(fl.tailSeq), ptr, fl.curVer)
+	fl.tailSeq++
+	// add a new tail node if it's full (the list is never empty)
+	if fl.seq2idx(fl.tailSeq) == 0 {
+		// try to reuse from the list head
+		next, head := flPop(fl) // may remove the head node
+		if next == 0 {
+			// or allocate a new node by appending
+			next = fl.New(make([]byte, fl.pageSize()))
+		}
+		// link to the new tail node
+		LNode(fl.Set(fl.tailPage)).setNext(next)
+		fl.tailPage = next
+		// also add the head node if it's removed
+		if head != 0 {
+			LNode(fl.Set(fl.tailPage)).setItem(0, head, fl.curVer)
+			fl.tailSeq++
+		}
+	}
+}
 
-func seq2idx(seq uint64) int {
-	return int(seq % FREE_LIST_CAP)
+func (fl *FreeList) pageSize() int {
+	if fl.PageSize == 0 {
+		return btree.BTREE_PAGE_SIZE
+	}
+	return fl.PageSize
+}
+
+func (fl *FreeList) seq2idx(seq uint64) int {
+	return int(seq % uint64(nodeCap(fl.pageSize())))
 }
 
 // make the newly added items available for consumption
@@ -42,20 +141,63 @@ func (fl *FreeList) SetMaxSeq() {
 	fl.maxSeq = fl.tailSeq
 }
 
+// `curVer` is the version of the current update, pages freed by it are
+// tagged with it. `maxVer` is the oldest version still used by a reader,
+// pages freed after it can't be reused.
+func (fl *FreeList) SetVersions(curVer, maxVer uint64) {
+	fl.curVer, fl.maxVer = curVer, maxVer
+}
+
 // remove 1 item from the head node, and remove the head node if empty.
 func flPop(fl *FreeList) (ptr uint64, head uint64) {
 	if fl.headSeq == fl.maxSeq {
 		return 0, 0 // cannot advance
 	}
 	node := LNode(fl.Get(fl.headPage))
-	ptr = node.getPtr(seq2idx(fl.headSeq)) // item
+	ptr, ver := node.getItem(fl.seq2idx(fl.headSeq)) // item
+	if ver > fl.maxVer {
+		return 0, 0 // cannot advance, still visible to a reader
+	}
 	fl.headSeq++
 	// move to the next one if the head node is empty
-	if seq2idx(fl.headSeq) == 0 {
+	if fl.seq2idx(fl.headSeq) == 0 {
 		head, fl.headPage = fl.headPage, node.getNext()
-		if fl.headPage != 0 {
-			panic("flPop: fl.headPage != 0")
+		if fl.headPage == 0 {
+			panic("flPop: fl.headPage == 0")
 		}
 	}
 	return
 }
+
+// walk the list from the head to the tail. `node` is called for every list
+// node before it's read, an error stops the walk. `item` is called for every item.
+func (fl *FreeList) Walk(node func(ptr uint64) error, item func(ptr uint64)) error {
+	if fl.headSeq > fl.tailSeq {
+		return errors.New("the head is past the tail")
+	}
+	page := fl.headPage
+	if err := node(page); err != nil {
+		return err
+	}
+	for seq := fl.headSeq; seq <= fl.tailSeq; seq++ {
+		// move to the next node
+		if seq != fl.headSeq && fl.seq2idx(seq) == 0 {
+			if page == fl.tailPage {
+				return errors.New("the tail node is not the last one")
+			}
+			page = LNode(fl.Get(page)).getNext()
+			if err := node(page); err != nil {
+				return err
+			}
+		}
+		if seq == fl.tailSeq {
+			break
+		}
+		ptr, _ := LNode(fl.Get(page)).getItem(fl.seq2idx(seq))
+		item(ptr)
+	}
+	if page != fl.tailPage {
+		return errors.New("the list does not end at the tail node")
+	}
+	return nil
+}